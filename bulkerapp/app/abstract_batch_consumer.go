@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
 	"github.com/jitsucom/bulker/bulkerapp/metrics"
 	bulker "github.com/jitsucom/bulker/bulkerlib"
 	"github.com/jitsucom/bulker/jitsubase/appbase"
@@ -20,17 +21,68 @@ const retryTimeHeader = "retry_time"
 const retriesCountHeader = "retries"
 const originalTopicHeader = "original_topic"
 
+// retryDelayHeader records the backoff duration (in milliseconds) that produced retryTimeHeader,
+// purely for observability - nothing reads it back to make a scheduling decision, unlike
+// retryTimeHeader itself.
+const retryDelayHeader = "retry_delay_ms"
+
 const pauseHeartBeatInterval = 10 * time.Second
 
-type BatchFunction func(destination *Destination, batchNum, batchSize, retryBatchSize int) (counters BatchCounters, nextBatch bool, err error)
+// partitionQueueSize bounds how many unprocessed messages a single partition's worker buffers
+// before the dispatcher's ReadMessage loop blocks trying to hand it the next one.
+const partitionQueueSize = 1000
+
+// BatchFunction processes messages for a single partition of topic: it drains messages (typically
+// up to batchSize, or until the channel goes quiet for a while) and commits/aborts via
+// partitionProducer against exactly that partition rather than the whole assignment. topic is
+// passed explicitly (rather than assumed to be the consumer's own topicId) so a single
+// pattern-subscribed consumer can multiplex batches across many destinations' topics while still
+// routing failed messages to the correct retry/DLQ topic for the one this batch came from.
+type BatchFunction func(destination *Destination, topic string, partition messaging.TopicPartition, batchNum int, messages <-chan *messaging.Message, partitionProducer messaging.TransactionalProducer, batchSize, retryBatchSize int) (counters BatchCounters, nextBatch bool, err error)
 
 type BatchConsumer interface {
 	RunJob()
 	ConsumeAll() (consumed BatchCounters, err error)
 	Retire()
+	Close(ctx context.Context) error
 	BatchPeriodSec() int
 	UpdateBatchPeriod(batchPeriodSec int)
 	TopicId() string
+	// CronSchedule returns the cron expression this consumer should be ticked on instead of the
+	// fixed BatchPeriodSec interval, or "" to keep the regular fixed-interval scheduling. RunJob
+	// itself is unaffected by which schedule drives it; Close already waits for an in-flight RunJob
+	// to finish (via the same lock ConsumeAll takes) regardless of what triggered it.
+	CronSchedule() string
+	// HighWaterMark returns the last sampled high-water-mark offset per partition number; entries
+	// for revoked partitions are kept.
+	HighWaterMark() map[int32]int64
+	// Lag returns the last sampled (highWaterMark - committedOffset) per partition number.
+	Lag() map[int32]int64
+}
+
+// partitionWorker owns one assigned (topic, partition): its own message queue (fed by the single
+// dispatcher goroutine that reads from the shared consumer) and its own transactional producer,
+// so that concurrent batches on different partitions never share a transactional.id. destinationId
+// and tableName are resolved once at assign time - from the consumer's own fields in single-topic
+// mode, or by parsing the dynamically-assigned topic when topicPattern is set.
+type partitionWorker struct {
+	partition     messaging.TopicPartition
+	topic         string
+	destinationId string
+	tableName     string
+	queue         chan *messaging.Message
+	producer      messaging.TransactionalProducer
+	stop          chan struct{}
+	// logger is keyed by this worker's own destinationId rather than the consumer-wide one, since
+	// in pattern mode several workers belonging to different destinations share one consumer.
+	logger *DestinationLogger
+}
+
+// partitionKey identifies a partitionWorker by (topic, partition) rather than just partition
+// number, since a pattern-subscribed consumer can have several topics assigned the same partition
+// number.
+func partitionKey(tp messaging.TopicPartition) string {
+	return fmt.Sprintf("%s-%d", tp.Topic, tp.Partition)
 }
 
 type AbstractBatchConsumer struct {
@@ -41,12 +93,29 @@ type AbstractBatchConsumer struct {
 	destinationId   string
 	batchPeriodSec  int
 	consumerConfig  kafka.ConfigMap
-	consumer        atomic.Pointer[kafka.Consumer]
-	producer        *kafka.Producer
+	producerConfig  kafka.ConfigMap
+	consumer        atomic.Pointer[messaging.BatchClient]
 	topicId         string
 	mode            string
 	tableName       string
 	waitForMessages time.Duration
+	// topicPattern marks this consumer as subscribed to a regex topic pattern (built via
+	// NewPatternBatchConsumer) rather than a single fixed topicId: destinationId/tableName are
+	// resolved per partitionWorker by parsing its dynamically-assigned topic instead of being
+	// fixed consumer-wide.
+	topicPattern bool
+	// subscription is the actual argument passed to Client.SubscribeTopics - topicId itself in
+	// single-topic mode, or the regex pattern in pattern mode (where topicId is just the groupId,
+	// used for logging/metrics, not something a broker can subscribe to). restartConsumer must
+	// resubscribe with this, not topicId, or a pattern consumer silently stops seeing any new
+	// topic match after its first reconnect.
+	subscription string
+
+	// assignor is non-nil only when the consumer was built with a CopartitioningStrategy. Its
+	// Name() is consulted to let rebalanceCallback detect (not enforce) after each rebalance
+	// whether the "copartitioned" invariant it documents actually holds for the topics this
+	// consumer is subscribed to - see PartitionAssignor's doc comment.
+	assignor PartitionAssignor
 
 	closed chan struct{}
 
@@ -58,9 +127,40 @@ type AbstractBatchConsumer struct {
 	paused        atomic.Bool
 	resumeChannel chan struct{}
 
+	// partitions holds one partitionWorker per currently-assigned (topic, partition), keyed by
+	// partitionKey, created and torn down by rebalanceCallback as AssignedPartitions/
+	// RevokedPartitions events arrive.
+	partitionsMu sync.Mutex
+	partitions   map[string]*partitionWorker
+
+	// lagMu guards highWaterMarks/lag, refreshed periodically by the lag sampler goroutine.
+	lagMu          sync.RWMutex
+	highWaterMarks map[int32]int64
+	lag            map[int32]int64
+
+	// transactionalProducers selects whether addPartitionWorker configures each partition's
+	// producer with a transactional.id and initializes transactions on it. RetryConsumer clears
+	// this for non-transactional retry mode (see NewRetryConsumer) since a transactional producer
+	// rejects Produce calls made outside an open transaction, which is exactly how
+	// processBatchNonTransactional uses partitionProducer.
+	transactionalProducers bool
+
+	// logger is this consumer's own structured, per-destination logger, so a single misbehaving
+	// destination's log level can be turned up via POST /log-level/{destinationId} (see
+	// destination_logger.go). In pattern mode it's keyed by "MULTI", since consumer-wide log lines
+	// (rebalance, restart, pause) aren't about any one destination - per-partition lines use
+	// partitionWorker.logger instead, keyed by that worker's own destinationId.
+	logger *DestinationLogger
+
 	batchFunc BatchFunction
 }
 
+// client returns the currently active messaging.BatchClient. bc.consumer is swapped out wholesale
+// by restartConsumer, never mutated in place.
+func (bc *AbstractBatchConsumer) client() messaging.BatchClient {
+	return *bc.consumer.Load()
+}
+
 func NewAbstractBatchConsumer(repository *Repository, destinationId string, batchPeriodSec int, topicId, mode string, config *Config, kafkaConfig *kafka.ConfigMap) (*AbstractBatchConsumer, error) {
 	base := appbase.NewServiceBase(topicId)
 	_, _, tableName, err := ParseTopicId(topicId)
@@ -79,93 +179,110 @@ func NewAbstractBatchConsumer(repository *Repository, destinationId string, batc
 	if config.BatchRunnerWaitForMessagesSec > 30 {
 		_ = consumerConfig.SetKey("session.timeout.ms", config.BatchRunnerWaitForMessagesSec*1000*2)
 	}
-	consumer, err := kafka.NewConsumer(&consumerConfig)
+	consumer, err := messaging.NewBatchClient(&consumerConfig)
 	if err != nil {
 		metrics.ConsumerErrors(topicId, mode, destinationId, tableName, metrics.KafkaErrorCode(err)).Inc()
 		return nil, base.NewError("Error creating consumer: %v", err)
 	}
-	// check topic partitions count
-	metadata, err := consumer.GetMetadata(&topicId, false, 10000)
-	if err != nil {
-		metrics.ConsumerErrors(topicId, mode, destinationId, tableName, metrics.KafkaErrorCode(err)).Inc()
-		return nil, base.NewError("Failed to get consumer metadata: %v", err)
-	}
-	for _, topic := range metadata.Topics {
-		if topic.Topic == topicId {
-			if len(topic.Partitions) > 1 {
-				metrics.ConsumerErrors(topicId, mode, destinationId, tableName, "invalid_partitions_count").Inc()
-				return nil, base.NewError("Topic has more than 1 partition. Batch Consumer supports only topics with a single partition")
-			}
-			break
-		}
+
+	bc := &AbstractBatchConsumer{
+		Service:                base,
+		config:                 config,
+		repository:             repository,
+		destinationId:          destinationId,
+		tableName:              tableName,
+		batchPeriodSec:         batchPeriodSec,
+		topicId:                topicId,
+		subscription:           topicId,
+		mode:                   mode,
+		consumerConfig:         consumerConfig,
+		producerConfig:         kafka.ConfigMap(*kafkaConfig),
+		waitForMessages:        time.Duration(config.BatchRunnerWaitForMessagesSec) * time.Second,
+		closed:                 make(chan struct{}),
+		resumeChannel:          make(chan struct{}),
+		partitions:             make(map[string]*partitionWorker),
+		highWaterMarks:         make(map[int32]int64),
+		lag:                    make(map[int32]int64),
+		transactionalProducers: true,
 	}
+	bc.logger = NewDestinationLogger(destinationId)
+	bc.consumer.Store(&consumer)
+	bc.idle.Store(true)
 
-	producerConfig := kafka.ConfigMap(utils.MapPutAll(kafka.ConfigMap{
-		"transactional.id": fmt.Sprintf("%s_failed_%s", topicId, config.InstanceId),
-	}, *kafkaConfig))
-	producer, err := kafka.NewProducer(&producerConfig)
+	err = consumer.SubscribeTopics([]string{topicId}, bc.rebalanceCallback)
 	if err != nil {
 		metrics.ConsumerErrors(topicId, mode, destinationId, tableName, metrics.KafkaErrorCode(err)).Inc()
 		_ = consumer.Close()
-		return nil, base.NewError("error creating kafka producer: %v", err)
+		return nil, base.NewError("Failed to subscribe to topic: %v", err)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
-	//enable transactions support for producer
-	err = producer.InitTransactions(ctx)
+	safego.RunWithRestart(bc.sampleLag)
+	return bc, nil
+}
+
+// NewPatternBatchConsumer builds an AbstractBatchConsumer that subscribes to every topic matching
+// topicPattern (a regex, e.g. "^in\\.id\\..*\\.m\\.batch\\..*$") instead of one fixed topicId. As
+// the group rebalances topics onto this process, rebalanceCallback parses each newly-assigned
+// topic with ParseTopicId and lazily leases the matching Destination from repository per batch
+// cycle - so new destinations start being consumed as soon as they produce to a matching topic,
+// without a bootstrap loop or config reload. groupId identifies the shared consumer group (there
+// is no single topicId to derive one from). copartitioningStrategy is typically
+// config.CopartitioningStrategy; when it's "copartitioned" rebalanceCallback validates, after every
+// rebalance, that every topic this consumer sees has the same partition count - the precondition
+// for the broker-side assignment to actually keep matching partition numbers together.
+func NewPatternBatchConsumer(repository *Repository, groupId, topicPattern, mode, copartitioningStrategy string, config *Config, kafkaConfig *kafka.ConfigMap) (*AbstractBatchConsumer, error) {
+	base := appbase.NewServiceBase(groupId)
+	consumerConfig := kafka.ConfigMap(utils.MapPutAll(kafka.ConfigMap{
+		"group.id":                      groupId,
+		"auto.offset.reset":             "earliest",
+		"group.instance.id":             config.InstanceId,
+		"enable.auto.commit":            false,
+		"partition.assignment.strategy": config.KafkaConsumerPartitionsAssigmentStrategy,
+		"isolation.level":               "read_committed",
+	}, *kafkaConfig))
+	if config.BatchRunnerWaitForMessagesSec > 30 {
+		_ = consumerConfig.SetKey("session.timeout.ms", config.BatchRunnerWaitForMessagesSec*1000*2)
+	}
+	consumer, err := messaging.NewBatchClient(&consumerConfig)
 	if err != nil {
-		metrics.ConsumerErrors(topicId, mode, destinationId, tableName, metrics.KafkaErrorCode(err)).Inc()
-		_ = consumer.Close()
-		return nil, base.NewError("error initializing kafka producer transactions for 'failed' producer: %v", err)
+		metrics.ConsumerErrors(groupId, mode, "MULTI", "MULTI", metrics.KafkaErrorCode(err)).Inc()
+		return nil, base.NewError("Error creating consumer: %v", err)
 	}
+
 	bc := &AbstractBatchConsumer{
-		Service:         base,
-		config:          config,
-		repository:      repository,
-		destinationId:   destinationId,
-		tableName:       tableName,
-		batchPeriodSec:  batchPeriodSec,
-		topicId:         topicId,
-		mode:            mode,
-		consumerConfig:  consumerConfig,
-		producer:        producer,
-		waitForMessages: time.Duration(config.BatchRunnerWaitForMessagesSec) * time.Second,
-		closed:          make(chan struct{}),
-		resumeChannel:   make(chan struct{}),
-	}
-	bc.consumer.Store(consumer)
+		Service:                base,
+		config:                 config,
+		repository:             repository,
+		batchPeriodSec:         0,
+		topicId:                groupId,
+		subscription:           topicPattern,
+		destinationId:          "MULTI",
+		tableName:              "MULTI",
+		mode:                   mode,
+		topicPattern:           true,
+		consumerConfig:         consumerConfig,
+		producerConfig:         kafka.ConfigMap(*kafkaConfig),
+		waitForMessages:        time.Duration(config.BatchRunnerWaitForMessagesSec) * time.Second,
+		closed:                 make(chan struct{}),
+		resumeChannel:          make(chan struct{}),
+		partitions:             make(map[string]*partitionWorker),
+		highWaterMarks:         make(map[int32]int64),
+		lag:                    make(map[int32]int64),
+		transactionalProducers: true,
+	}
+	bc.logger = NewDestinationLogger(bc.destinationId)
+	if copartitioningStrategy != "" {
+		bc.assignor = NewPartitionAssignor(copartitioningStrategy)
+	}
+	bc.consumer.Store(&consumer)
 	bc.idle.Store(true)
 
-	err = consumer.Subscribe(topicId, bc.rebalanceCallback)
+	err = consumer.SubscribeTopics([]string{topicPattern}, bc.rebalanceCallback)
 	if err != nil {
-		metrics.ConsumerErrors(topicId, mode, destinationId, tableName, metrics.KafkaErrorCode(err)).Inc()
+		metrics.ConsumerErrors(groupId, mode, "MULTI", "MULTI", metrics.KafkaErrorCode(err)).Inc()
 		_ = consumer.Close()
-		return nil, base.NewError("Failed to subscribe to topic: %v", err)
+		return nil, base.NewError("Failed to subscribe to topic pattern %s: %v", topicPattern, err)
 	}
-
-	// Delivery reports channel for 'failed' producer messages
-	safego.RunWithRestart(func() {
-		for {
-			select {
-			case <-bc.closed:
-				bc.Infof("Closing producer.")
-				bc.producer.Close()
-				return
-			case e := <-bc.producer.Events():
-				switch ev := e.(type) {
-				case *kafka.Message:
-					messageId := GetKafkaHeader(ev, MessageIdHeader)
-					if ev.TopicPartition.Error != nil {
-						bc.Errorf("Error sending message (ID: %s) to kafka topic %s: %s", messageId, *ev.TopicPartition.Topic, ev.TopicPartition.Error.Error())
-					} else {
-						bc.Debugf("Message ID: %s delivered to topic %s [%d] at offset %v", messageId, *ev.TopicPartition.Topic, ev.TopicPartition.Partition, ev.TopicPartition.Offset)
-					}
-					//case kafka.Error:
-					//	bc.Errorf("Producer error: %v", ev)
-				}
-			}
-		}
-	})
+	safego.RunWithRestart(bc.sampleLag)
 	return bc, nil
 }
 
@@ -181,18 +298,28 @@ func (bc *AbstractBatchConsumer) TopicId() string {
 	return bc.topicId
 }
 
+// CronSchedule returns "" by default: a plain AbstractBatchConsumer is always scheduled on its
+// fixed BatchPeriodSec interval. See RetryConsumer.CronSchedule for the cron-driven alternative.
+func (bc *AbstractBatchConsumer) CronSchedule() string {
+	return ""
+}
+
 func (bc *AbstractBatchConsumer) RunJob() {
 	_, _ = bc.ConsumeAll()
 }
 
+// ConsumeAll runs one batch cycle across every currently-assigned partition in parallel: a single
+// dispatcher goroutine reads from the shared consumer and fans messages out by partition, while
+// one goroutine per partition drives batchFunc against its own queue and transactional producer.
 func (bc *AbstractBatchConsumer) ConsumeAll() (counters BatchCounters, err error) {
 	bc.Lock()
 	defer bc.Unlock()
+	logFields := Fields{Topic: bc.topicId}
 	if bc.retired.Load() {
-		bc.Errorf("No messages were consumed. Consumer is retired.")
+		bc.logger.Errorf(logFields, "No messages were consumed. Consumer is retired.")
 		return BatchCounters{}, bc.NewError("Consumer is retired")
 	}
-	bc.Debugf("Starting consuming messages from topic")
+	bc.logger.Debugf(logFields, "Starting consuming messages from topic")
 	bc.idle.Store(false)
 	defer func() {
 		bc.idle.Store(true)
@@ -200,39 +327,134 @@ func (bc *AbstractBatchConsumer) ConsumeAll() (counters BatchCounters, err error
 		bc.countersMetric(counters)
 		if err != nil {
 			metrics.ConsumerRuns(bc.topicId, bc.mode, bc.destinationId, bc.tableName, "fail").Inc()
-			bc.Errorf("Consume finished with error: %v stats: %s", err, counters)
+			bc.logger.Errorf(logFields, "Consume finished with error: %v stats: %s", err, counters)
 		} else {
 			metrics.ConsumerRuns(bc.topicId, bc.mode, bc.destinationId, bc.tableName, "success").Inc()
 			if counters.processed > 0 {
-				bc.Infof("Successfully %s", counters.String())
+				bc.logger.Infof(logFields, "Successfully %s", counters.String())
 			} else {
 				countersString := counters.String()
 				if countersString != "" {
 					countersString = ": " + countersString
-					bc.Infof("No messages were processed%s", countersString)
+					bc.logger.Infof(logFields, "No messages were processed%s", countersString)
 				} else {
-					bc.Debugf("No messages were processed")
+					bc.logger.Debugf(logFields, "No messages were processed")
 				}
 			}
 		}
 	}()
-	destination := bc.repository.LeaseDestination(bc.destinationId)
-	if destination == nil {
-		bc.Retire()
-		return BatchCounters{}, bc.NewError("destination not found: %s. Retiring consumer", bc.destinationId)
+	// In single-topic mode destinationId is fixed and missing it means this whole consumer has
+	// nothing left to do. In pattern mode each worker lazily leases its own destination instead
+	// (see runPartitionBatches), since one multiplexed consumer can outlive any single topic.
+	if !bc.topicPattern {
+		destination := bc.repository.LeaseDestination(bc.destinationId)
+		if destination == nil {
+			bc.Retire()
+			return BatchCounters{}, bc.NewError("destination not found: %s. Retiring consumer", bc.destinationId)
+		}
+		defer destination.Release()
 	}
-	defer func() {
-		destination.Release()
-	}()
 
-	maxBatchSize := bulker.BatchSizeOption.Get(destination.streamOptions)
-	if maxBatchSize <= 0 {
-		maxBatchSize = bc.config.BatchRunnerDefaultBatchSize
+	bc.resume()
+
+	workers := bc.snapshotPartitionWorkers()
+	if len(workers) == 0 {
+		return BatchCounters{}, nil
 	}
 
+	dispatchDone := make(chan struct{})
+	go bc.dispatch(dispatchDone)
+	defer close(dispatchDone)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker *partitionWorker) {
+			defer wg.Done()
+			partitionCounters, werr := bc.runPartitionBatches(worker)
+			mu.Lock()
+			counters.accumulate(partitionCounters)
+			if werr != nil {
+				err = werr
+			}
+			mu.Unlock()
+		}(worker)
+	}
+	wg.Wait()
+	return
+}
+
+// dispatch is the single goroutine allowed to call ReadMessage on the shared consumer; it routes
+// each message to the queue of the partition worker it belongs to until done is closed. It looks
+// the worker up in bc.partitions (under partitionsMu) on every message rather than a snapshot taken
+// once at the start of the batch cycle, so a partition assigned mid-cycle (rebalanceCallback runs
+// concurrently with dispatch) still gets its messages queued instead of them being silently
+// dropped until the next cycle's snapshot picks it up. Looking the worker up and sending to its
+// queue under the same lock that removePartitionWorker closes that queue under also rules out ever
+// sending on a closed channel: a worker can only disappear from bc.partitions and have its queue
+// closed as one atomic step, so dispatch can never observe it as present after that step happens.
+//
+// Known limitation: since ReadMessage can only be called by this one goroutine, a partition whose
+// queue is full (its runPartitionBatches is stuck or slow) blocks dispatch - and therefore every
+// other partition - until it drains. Fanning reads out across per-partition goroutines would need
+// one client per partition rather than one shared group member, which is a larger change than this
+// fix.
+func (bc *AbstractBatchConsumer) dispatch(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-bc.closed:
+			return
+		default:
+		}
+		client := bc.client()
+		message, err := client.ReadMessage(bc.waitForMessages)
+		if err != nil {
+			if !client.IsTimeout(err) {
+				bc.errorMetric("dispatch_error")
+			}
+			continue
+		}
+		tp := messaging.TopicPartition{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset}
+		bc.partitionsMu.Lock()
+		worker, ok := bc.partitions[partitionKey(tp)]
+		if !ok {
+			bc.partitionsMu.Unlock()
+			// partition was revoked before this message could be routed; it will be redelivered
+			// to whichever consumer it gets reassigned to after the rebalance settles.
+			continue
+		}
+		select {
+		case worker.queue <- message:
+		case <-done:
+			bc.partitionsMu.Unlock()
+			return
+		}
+		bc.partitionsMu.Unlock()
+	}
+}
+
+// runPartitionBatches leases worker's destination (fresh, every batch cycle, so destination config
+// changes are picked up without a rebalance) and repeatedly invokes batchFunc until it reports
+// nextBatch false.
+func (bc *AbstractBatchConsumer) runPartitionBatches(worker *partitionWorker) (counters BatchCounters, err error) {
+	destination := bc.repository.LeaseDestination(worker.destinationId)
+	if destination == nil {
+		bc.partitionErrorMetric(worker, "destination_not_found")
+		worker.logger.Errorf(Fields{Topic: worker.topic, Partition: worker.partition.Partition}, "destination not found: %s (topic %s). Skipping partition this cycle", worker.destinationId, worker.topic)
+		return BatchCounters{}, nil
+	}
+	defer destination.Release()
+
+	batchSize := bulker.BatchSizeOption.Get(destination.streamOptions)
+	if batchSize <= 0 {
+		batchSize = bc.config.BatchRunnerDefaultBatchSize
+	}
 	retryBatchSize := bulker.RetryBatchSizeOption.Get(destination.streamOptions)
 	if retryBatchSize <= 0 {
-		retryBatchSize = int(float64(maxBatchSize) * bc.config.BatchRunnerDefaultRetryBatchFraction)
+		retryBatchSize = int(float64(batchSize) * bc.config.BatchRunnerDefaultRetryBatchFraction)
 	}
 
 	batchNumber := 1
@@ -240,11 +462,9 @@ func (bc *AbstractBatchConsumer) ConsumeAll() (counters BatchCounters, err error
 		if bc.retired.Load() {
 			return
 		}
-		batchStats, nextBatch, err2 := bc.processBatch(destination, batchNumber, maxBatchSize, retryBatchSize)
-		if err2 != nil {
-			if nextBatch {
-				bc.Errorf("Batch finished with error: %v stats: %s nextBatch: %t", err2, batchStats, nextBatch)
-			}
+		batchStats, nextBatch, err2 := bc.batchFunc(destination, worker.topic, worker.partition, batchNumber, worker.queue, worker.producer, batchSize, retryBatchSize)
+		if err2 != nil && nextBatch {
+			worker.logger.Errorf(Fields{Topic: worker.topic, Partition: worker.partition.Partition}, "Batch finished with error on partition %d of topic %s: %v stats: %s nextBatch: %t", worker.partition.Partition, worker.topic, err2, batchStats, nextBatch)
 		}
 		counters.accumulate(batchStats)
 		if !nextBatch {
@@ -261,19 +481,14 @@ func (bc *AbstractBatchConsumer) close() error {
 	default:
 		close(bc.closed)
 	}
-	return bc.consumer.Load().Close()
-}
-
-func (bc *AbstractBatchConsumer) processBatch(destination *Destination, batchNum, batchSize, retryBatchSize int) (counters BatchCounters, nextBath bool, err error) {
-	bc.resume()
-	return bc.batchFunc(destination, batchNum, batchSize, retryBatchSize)
+	return bc.client().Close()
 }
 
 // pause consumer.
 func (bc *AbstractBatchConsumer) pause() {
 	if bc.idle.Load() && bc.retired.Load() {
 		// Close retired idling consumer
-		bc.Infof("Consumer is retired. Closing")
+		bc.logger.Infof(Fields{Topic: bc.topicId}, "Consumer is retired. Closing")
 		_ = bc.close()
 		return
 	}
@@ -291,39 +506,39 @@ func (bc *AbstractBatchConsumer) pause() {
 		for {
 			if bc.idle.Load() && bc.retired.Load() {
 				// Close retired idling consumer
-				bc.Infof("Consumer is retired. Closing")
+				bc.logger.Infof(Fields{Topic: bc.topicId}, "Consumer is retired. Closing")
 				_ = bc.close()
 				return
 			}
 			select {
 			case <-bc.resumeChannel:
 				bc.paused.Store(false)
-				bc.Debugf("Consumer resumed.")
+				bc.logger.Debugf(Fields{Topic: bc.topicId}, "Consumer resumed.")
 				break loop
 			case <-pauseTicker.C:
 			}
-			message, err := bc.consumer.Load().ReadMessage(bc.waitForMessages)
+			client := bc.client()
+			message, err := client.ReadMessage(bc.waitForMessages)
 			if err != nil {
-				kafkaErr := err.(kafka.Error)
-				if kafkaErr.Code() == kafka.ErrTimedOut {
-					bc.Debugf("Consumer paused. Heartbeat sent.")
+				if client.IsTimeout(err) {
+					bc.logger.Debugf(Fields{Topic: bc.topicId}, "Consumer paused. Heartbeat sent.")
 					continue
 				}
 				bc.errorMetric("error_while_paused")
 				if !errorReported {
-					bc.Errorf("Error on paused consumer: %v", kafkaErr)
+					bc.logger.Errorf(Fields{Topic: bc.topicId}, "Error on paused consumer: %v", err)
 					errorReported = true
 				}
-				if kafkaErr.IsRetriable() {
+				if client.IsRetriable(err) {
 					time.Sleep(pauseHeartBeatInterval)
 				} else {
 					bc.restartConsumer()
 				}
 			} else if message != nil {
-				bc.Debugf("Unexpected message on paused consumer: %v", message)
+				bc.logger.Debugf(Fields{Topic: bc.topicId}, "Unexpected message on paused consumer: %v", message)
 				//If message slipped through pause, rollback offset and make sure consumer is paused
-				_, err = bc.consumer.Load().SeekPartitions([]kafka.TopicPartition{message.TopicPartition})
-				if err != nil {
+				tp := messaging.TopicPartition{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset}
+				if err = client.SeekPartitions([]messaging.TopicPartition{tp}); err != nil {
 					bc.errorMetric("ROLLBACK_ON_PAUSE_ERR")
 					bc.SystemErrorf("Failed to rollback offset on paused consumer: %v", err)
 				}
@@ -337,12 +552,12 @@ func (bc *AbstractBatchConsumer) restartConsumer() {
 	if bc.retired.Load() {
 		return
 	}
-	bc.Infof("Restarting consumer")
-	go func(c *kafka.Consumer) {
-		bc.Infof("Closing previous consumer")
+	bc.logger.Infof(Fields{Topic: bc.topicId}, "Restarting consumer")
+	go func(c messaging.BatchClient) {
+		bc.logger.Infof(Fields{Topic: bc.topicId}, "Closing previous consumer")
 		err := c.Close()
-		bc.Infof("Previous consumer closed: %v", err)
-	}(bc.consumer.Load())
+		bc.logger.Infof(Fields{Topic: bc.topicId}, "Previous consumer closed: %v", err)
+	}(bc.client())
 
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -357,59 +572,208 @@ func (bc *AbstractBatchConsumer) restartConsumer() {
 				return
 			}
 		case <-ticker.C:
-			bc.Infof("Restarting consumer")
-			consumer, err := kafka.NewConsumer(&bc.consumerConfig)
+			bc.logger.Infof(Fields{Topic: bc.topicId}, "Restarting consumer")
+			consumer, err := messaging.NewBatchClient(&bc.consumerConfig)
 			if err != nil {
 				bc.errorMetric("consumer_error:" + metrics.KafkaErrorCode(err))
-				bc.Errorf("Error creating kafka consumer: %v", err)
+				bc.logger.Errorf(Fields{Topic: bc.topicId}, "Error creating kafka consumer: %v", err)
 				break
 			}
-			err = consumer.SubscribeTopics([]string{bc.topicId}, bc.rebalanceCallback)
+			err = consumer.SubscribeTopics([]string{bc.subscription}, bc.rebalanceCallback)
 			if err != nil {
 				bc.errorMetric("consumer_error:" + metrics.KafkaErrorCode(err))
 				_ = consumer.Close()
-				bc.Errorf("Failed to subscribe to topic: %v", err)
+				bc.logger.Errorf(Fields{Topic: bc.topicId}, "Failed to subscribe to topic: %v", err)
 				break
 			}
-			bc.consumer.Store(consumer)
-			bc.Infof("Restarted successfully")
+			bc.consumer.Store(&consumer)
+			bc.logger.Infof(Fields{Topic: bc.topicId}, "Restarted successfully")
 			return
 		}
 	}
 }
 
 func (bc *AbstractBatchConsumer) pauseKafkaConsumer() {
-	partitions, err := bc.consumer.Load().Assignment()
+	client := bc.client()
+	partitions, err := client.Assignment()
 	if len(partitions) > 0 {
-		err = bc.consumer.Load().Pause(partitions)
+		err = client.Pause(partitions)
 	}
 	if err != nil {
 		bc.errorMetric("pause_error")
 		bc.SystemErrorf("Failed to pause kafka consumer: %v", err)
 	} else {
 		if len(partitions) > 0 {
-			bc.Debugf("Consumer paused.")
+			bc.logger.Debugf(Fields{Topic: bc.topicId}, "Consumer paused.")
 		}
 		// otherwise rebalanceCallback will handle pausing
 	}
 }
 
-func (bc *AbstractBatchConsumer) rebalanceCallback(consumer *kafka.Consumer, event kafka.Event) error {
-	assignedParts, ok := event.(kafka.AssignedPartitions)
-	bc.Debugf("Rebalance event: %v . Paused: %t", event, bc.paused.Load())
-	if ok && bc.paused.Load() {
-		err := consumer.Pause(assignedParts.Partitions)
+// rebalanceCallback keeps bc.partitions in sync with the consumer group's current assignment: a
+// partitionWorker (queue + dedicated transactional producer) is started for every newly assigned
+// partition and torn down for every revoked one.
+func (bc *AbstractBatchConsumer) rebalanceCallback(assigned bool, partitions []messaging.TopicPartition) error {
+	bc.logger.Debugf(Fields{Topic: bc.topicId}, "Rebalance event (assigned=%t): %v . Paused: %t", assigned, partitions, bc.paused.Load())
+	if assigned {
+		if bc.paused.Load() {
+			if err := bc.client().Pause(partitions); err != nil {
+				bc.errorMetric("pause_error")
+				bc.SystemErrorf("Failed to pause kafka consumer: %v", err)
+				return err
+			}
+			bc.logger.Debugf(Fields{Topic: bc.topicId}, "Consumer paused.")
+		}
+		for _, tp := range partitions {
+			if err := bc.addPartitionWorker(tp); err != nil {
+				bc.errorMetric("partition_worker_error")
+				bc.logger.Errorf(Fields{Topic: bc.topicId, Partition: tp.Partition}, "Failed to start worker for partition %d: %v", tp.Partition, err)
+			}
+		}
+		if bc.assignor != nil && bc.assignor.Name() == "copartitioned" {
+			bc.validateCopartitioning(partitions)
+		}
+	} else {
+		for _, tp := range partitions {
+			bc.removePartitionWorker(tp)
+		}
+	}
+	return nil
+}
+
+// validateCopartitioning checks that every distinct topic among assignedPartitions has the same
+// partition count. Equal partition counts are the precondition for the group's chosen
+// KafkaConsumerPartitionsAssigmentStrategy to actually keep matching partition numbers of
+// co-partitioned topics on the same consumer instance - a mismatch means CopartitioningStrategy was
+// configured over topics that can never be joined, so it's reported as an error rather than
+// silently producing partial joins.
+func (bc *AbstractBatchConsumer) validateCopartitioning(assignedPartitions []messaging.TopicPartition) {
+	client := bc.client()
+	seen := make(map[string]bool)
+	partitionCounts := make(map[string]int)
+	for _, tp := range assignedPartitions {
+		if tp.Topic == "" || seen[tp.Topic] {
+			continue
+		}
+		seen[tp.Topic] = true
+		count, err := client.PartitionCount(tp.Topic)
 		if err != nil {
-			bc.errorMetric("pause_error")
-			bc.SystemErrorf("Failed to pause kafka consumer: %v", err)
-			return err
-		} else {
-			bc.Debugf("Consumer paused.")
+			bc.errorMetric("copartitioning_metadata_error")
+			bc.logger.Errorf(Fields{Topic: tp.Topic}, "Failed to fetch metadata for topic %s while validating copartitioning: %v", tp.Topic, err)
+			continue
+		}
+		partitionCounts[tp.Topic] = count
+	}
+	var first string
+	for topic, count := range partitionCounts {
+		if first == "" {
+			first = topic
+			continue
+		}
+		if count != partitionCounts[first] {
+			bc.errorMetric("copartitioning_violation")
+			bc.logger.Errorf(Fields{Topic: bc.topicId}, "Copartitioning violation: topic %s has %d partitions but %s has %d", topic, count, first, partitionCounts[first])
 		}
 	}
+}
+
+// addPartitionWorker starts a partitionWorker for tp: its own bounded queue and, when
+// transactionalProducers is set, its own transactional producer (transactional.id suffixed by
+// topic and partition number) so that concurrent batches on different partitions never collide
+// inside a shared transaction. When transactionalProducers is false (non-transactional
+// RetryConsumer), the producer is created without transactional.id and never has InitTransactions
+// called on it, since a transactional producer rejects Produce calls made outside an open
+// transaction - exactly how processBatchNonTransactional uses it. In single-topic mode
+// destinationId/tableName are just the consumer's own fields; in pattern mode they're resolved by
+// parsing tp.Topic with ParseTopicId, since tp can belong to any destination's topic that happens
+// to match the subscription pattern.
+func (bc *AbstractBatchConsumer) addPartitionWorker(tp messaging.TopicPartition) error {
+	bc.partitionsMu.Lock()
+	defer bc.partitionsMu.Unlock()
+	key := partitionKey(tp)
+	if _, ok := bc.partitions[key]; ok {
+		return nil
+	}
+	topic := tp.Topic
+	destinationId, tableName := bc.destinationId, bc.tableName
+	if bc.topicPattern {
+		var err error
+		destinationId, _, tableName, err = ParseTopicId(topic)
+		if err != nil {
+			return bc.NewError("error parsing topic %s for partition %d: %v", topic, tp.Partition, err)
+		}
+	}
+	producerOverrides := map[string]string{}
+	if bc.transactionalProducers {
+		producerOverrides["transactional.id"] = fmt.Sprintf("%s_failed_%s_p%d", topic, bc.config.InstanceId, tp.Partition)
+	}
+	producer, err := bc.client().NewPartitionProducer(producerOverrides, bc.transactionalProducers)
+	if err != nil {
+		return bc.NewError("error creating kafka producer for partition %d: %v", tp.Partition, err)
+	}
+	worker := &partitionWorker{
+		partition:     tp,
+		topic:         topic,
+		destinationId: destinationId,
+		tableName:     tableName,
+		queue:         make(chan *messaging.Message, partitionQueueSize),
+		producer:      producer,
+		stop:          make(chan struct{}),
+		logger:        NewDestinationLogger(destinationId),
+	}
+	bc.partitions[key] = worker
+	safego.RunWithRestart(func() {
+		events := worker.producer.Events()
+		for {
+			select {
+			case <-worker.stop:
+				worker.producer.Close()
+				return
+			case report, ok := <-events:
+				if !ok {
+					return
+				}
+				msgFields := Fields{Topic: report.Message.Topic, Partition: report.Message.Partition, Offset: report.Message.Offset}
+				messageId := report.Message.Header(MessageIdHeader)
+				if report.Err != nil {
+					worker.logger.Errorf(msgFields, "Error sending message (ID: %s) to kafka topic %s: %s", messageId, report.Message.Topic, report.Err.Error())
+				} else {
+					worker.logger.Debugf(msgFields, "Message ID: %s delivered to topic %s [%d] at offset %v", messageId, report.Message.Topic, report.Message.Partition, report.Message.Offset)
+				}
+			}
+		}
+	})
 	return nil
 }
 
+func (bc *AbstractBatchConsumer) removePartitionWorker(tp messaging.TopicPartition) {
+	bc.partitionsMu.Lock()
+	defer bc.partitionsMu.Unlock()
+	key := partitionKey(tp)
+	worker, ok := bc.partitions[key]
+	if !ok {
+		return
+	}
+	delete(bc.partitions, key)
+	close(worker.stop)
+	// Closing queue (rather than leaving it for garbage collection once stop fires) lets a batch
+	// mid-flight on this partition observe the close as soon as its current queue receive returns
+	// nil, instead of blocking on waitForMessages until it notices stop separately. Safe to close
+	// here because dispatch only ever sends to a worker's queue while holding partitionsMu, and the
+	// worker is removed from bc.partitions under that same lock before the close below runs.
+	close(worker.queue)
+}
+
+func (bc *AbstractBatchConsumer) snapshotPartitionWorkers() map[string]*partitionWorker {
+	bc.partitionsMu.Lock()
+	defer bc.partitionsMu.Unlock()
+	snapshot := make(map[string]*partitionWorker, len(bc.partitions))
+	for k, v := range bc.partitions {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
 func (bc *AbstractBatchConsumer) resume() {
 	if !bc.paused.Load() {
 		return
@@ -421,13 +785,14 @@ func (bc *AbstractBatchConsumer) resume() {
 			bc.SystemErrorf("failed to resume kafka consumer.: %v", err)
 		}
 	}()
-	partitions, err := bc.consumer.Load().Assignment()
+	client := bc.client()
+	partitions, err := client.Assignment()
 	if err != nil {
 		return
 	}
 	select {
 	case bc.resumeChannel <- struct{}{}:
-		err = bc.consumer.Load().Resume(partitions)
+		err = client.Resume(partitions)
 	case <-time.After(pauseHeartBeatInterval * 3):
 		err = bc.NewError("Resume timeout.")
 		//return bc.consumer.Resume(partitions)
@@ -437,13 +802,38 @@ func (bc *AbstractBatchConsumer) resume() {
 // Retire Mark consumer as retired
 // Consumer will close itself when com
 func (bc *AbstractBatchConsumer) Retire() {
-	bc.Infof("Retiring %s consumer", bc.mode)
+	bc.logger.Infof(Fields{Topic: bc.topicId}, "Retiring %s consumer", bc.mode)
 	bc.retired.Store(true)
 }
+
+// Close retires the consumer and waits, up to ctx's deadline, for any batch currently in
+// ConsumeAll to finish committing/aborting its transaction before closing the kafka consumer.
+func (bc *AbstractBatchConsumer) Close(ctx context.Context) error {
+	bc.Retire()
+	drained := make(chan struct{})
+	go func() {
+		bc.Lock()
+		defer bc.Unlock()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		bc.logger.Errorf(Fields{Topic: bc.topicId}, "Shutdown deadline exceeded waiting for in-flight batch to finish")
+	}
+	return bc.close()
+}
+
 func (bc *AbstractBatchConsumer) errorMetric(errorType string) {
 	metrics.ConsumerErrors(bc.topicId, bc.mode, bc.destinationId, bc.tableName, errorType).Inc()
 }
 
+// partitionErrorMetric is like errorMetric but labelled with worker's own destinationId/tableName
+// rather than the consumer-wide ones, which are just "MULTI" in pattern mode.
+func (bc *AbstractBatchConsumer) partitionErrorMetric(worker *partitionWorker, errorType string) {
+	metrics.ConsumerErrors(bc.topicId, bc.mode, worker.destinationId, worker.tableName, errorType).Inc()
+}
+
 func (bc *AbstractBatchConsumer) countersMetric(counters BatchCounters) {
 	countersValue := reflect.ValueOf(counters)
 	countersType := countersValue.Type()
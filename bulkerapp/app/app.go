@@ -27,6 +27,7 @@ type Context struct {
 	server              *http.Server
 	metricsServer       *MetricsServer
 	metricsRelay        *MetricsRelay
+	dlqReplayer         *DeadLetterReplayer
 }
 
 func (a *Context) InitContext(settings *appbase.AppSettings) error {
@@ -83,6 +84,8 @@ func (a *Context) InitContext(settings *appbase.AppSettings) error {
 	}
 
 	router := NewRouter(a)
+	a.dlqReplayer = NewDeadLetterReplayer(a.config, a.kafkaConfig, a.producer, router)
+	RegisterLogLevelRoute(router)
 	a.server = &http.Server{
 		Addr:              fmt.Sprintf("0.0.0.0:%d", a.config.HTTPPort),
 		Handler:           router.Engine(),
@@ -101,21 +104,24 @@ func (a *Context) InitContext(settings *appbase.AppSettings) error {
 	return nil
 }
 
-// TODO: graceful shutdown and cleanups. Flush producer
-func (a *Context) Shutdown() error {
-	_ = a.producer.Close()
-	_ = a.topicManager.Close()
+// Shutdown gracefully stops all long-running goroutines, giving in-flight consumer/producer
+// work up to ShutdownExtraDelay seconds (bounded by ctx) to drain before tearing down the rest.
+func (a *Context) Shutdown(ctx context.Context) error {
+	shutdownCtx := ctx
+	if a.config.ShutdownExtraDelay > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(ctx, time.Duration(a.config.ShutdownExtraDelay)*time.Second)
+		defer cancel()
+	}
+	_ = a.producer.Close(shutdownCtx)
+	_ = a.topicManager.Close(shutdownCtx)
 	a.cron.Close()
 	_ = a.repository.Close()
 	_ = a.configurationSource.Close()
-	if a.config.ShutdownExtraDelay > 0 {
-		logging.Infof("Waiting %d seconds before http server shutdown...", a.config.ShutdownExtraDelay)
-		time.Sleep(time.Duration(a.config.ShutdownExtraDelay) * time.Second)
-	}
 	logging.Infof("Shutting down http server...")
 	_ = a.metricsServer.Stop()
 	_ = a.metricsRelay.Stop()
-	_ = a.server.Shutdown(context.Background())
+	_ = a.server.Shutdown(shutdownCtx)
 	_ = a.eventsLogService.Close()
 	_ = a.fastStore.Close()
 	return nil
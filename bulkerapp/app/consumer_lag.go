@@ -0,0 +1,102 @@
+package app
+
+import (
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerapp/metrics"
+	"strconv"
+	"time"
+)
+
+// lagSampleInterval is how often sampleLag refreshes highWaterMarks/lag for every currently
+// assigned partition.
+const lagSampleInterval = 30 * time.Second
+
+// lagQueryTimeout bounds each QueryWatermarkOffsets/Committed call against the broker.
+const lagQueryTimeout = 10 * time.Second
+
+// sampleLag runs for the lifetime of the consumer, periodically querying the high-water-mark and
+// committed offset of every assigned partition and publishing lag = highWaterMark - committed as
+// a gauge, so an operator can see how far behind a destination is without waiting for it to show
+// up as consumed/processed counters.
+func (bc *AbstractBatchConsumer) sampleLag() {
+	ticker := time.NewTicker(lagSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-bc.closed:
+			return
+		case <-ticker.C:
+			bc.sampleLagOnce()
+		}
+	}
+}
+
+func (bc *AbstractBatchConsumer) sampleLagOnce() {
+	for _, worker := range bc.snapshotPartitionWorkers() {
+		partition := worker.partition.Partition
+		client := bc.client()
+		_, high, err := client.QueryWatermarkOffsets(worker.topic, partition, lagQueryTimeout)
+		if err != nil {
+			bc.errorMetric("query_watermark_error")
+			continue
+		}
+		committed, err := client.Committed([]messaging.TopicPartition{worker.partition}, lagQueryTimeout)
+		if err != nil || len(committed) == 0 {
+			bc.errorMetric("query_committed_error")
+			continue
+		}
+		committedOffset := committed[0].Offset
+		if committedOffset < 0 {
+			// no committed offset yet for this partition
+			committedOffset = 0
+		}
+		lag := high - committedOffset
+		if lag < 0 {
+			lag = 0
+		}
+
+		bc.lagMu.Lock()
+		bc.highWaterMarks[partition] = high
+		bc.lag[partition] = lag
+		bc.lagMu.Unlock()
+
+		partitionLabel := strconv.Itoa(int(partition))
+		metrics.ConsumerHighWaterMark(bc.topicId, bc.mode, bc.destinationId, partitionLabel).Set(float64(high))
+		metrics.ConsumerLag(bc.topicId, bc.mode, bc.destinationId, partitionLabel).Set(float64(lag))
+	}
+}
+
+// HighWaterMark returns the last sampled high-water-mark offset per partition number. Entries are
+// not removed when a partition is revoked, and in pattern mode same-numbered partitions of
+// different topics share one entry.
+func (bc *AbstractBatchConsumer) HighWaterMark() map[int32]int64 {
+	bc.lagMu.RLock()
+	defer bc.lagMu.RUnlock()
+	snapshot := make(map[int32]int64, len(bc.highWaterMarks))
+	for k, v := range bc.highWaterMarks {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+// Lag returns the last sampled (highWaterMark - committedOffset) per partition number, with the
+// same keying as HighWaterMark.
+func (bc *AbstractBatchConsumer) Lag() map[int32]int64 {
+	bc.lagMu.RLock()
+	defer bc.lagMu.RUnlock()
+	snapshot := make(map[int32]int64, len(bc.lag))
+	for k, v := range bc.lag {
+		snapshot[k] = v
+	}
+	return snapshot
+}
+
+// totalLag sums Lag() across all partitions, used by RetryConsumer to skip a batch cycle when
+// there's nothing meaningfully behind.
+func (bc *AbstractBatchConsumer) totalLag() int64 {
+	var total int64
+	for _, l := range bc.Lag() {
+		total += l
+	}
+	return total
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jitsucom/bulker/jitsubase/logging"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// logLevelOverride is a temporary elevation of a single destination's log verbosity, set via
+// POST /log-level/{destinationId} and automatically reverted once ttl elapses.
+type logLevelOverride struct {
+	level   string
+	expires time.Time
+}
+
+// logLevelRegistry is a concurrent-safe map of destinationId -> logLevelOverride, shared by every
+// DestinationLogger and by the HTTP handler that sets overrides.
+type logLevelRegistry struct {
+	mu        sync.RWMutex
+	overrides map[string]logLevelOverride
+}
+
+var logLevels = &logLevelRegistry{overrides: make(map[string]logLevelOverride)}
+
+// Set elevates destinationId's log level until ttl elapses.
+func (r *logLevelRegistry) Set(destinationId, level string, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.overrides[destinationId] = logLevelOverride{level: level, expires: time.Now().Add(ttl)}
+}
+
+// effective returns the active override level for destinationId, or "" if none is set or it has
+// expired.
+func (r *logLevelRegistry) effective(destinationId string) string {
+	r.mu.RLock()
+	override, ok := r.overrides[destinationId]
+	r.mu.RUnlock()
+	if !ok {
+		return ""
+	}
+	if time.Now().After(override.expires) {
+		r.mu.Lock()
+		delete(r.overrides, destinationId)
+		r.mu.Unlock()
+		return ""
+	}
+	return override.level
+}
+
+// Fields is the structured context a DestinationLogger call line includes, so operators can grep
+// a single destination's trace without flipping the global log level.
+type Fields struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Retries   int
+}
+
+func (f Fields) String() string {
+	return fmt.Sprintf("topic=%s partition=%d offset=%d retries=%d", f.Topic, f.Partition, f.Offset, f.Retries)
+}
+
+// DestinationLogger is a structured, per-destination logger keyed by destinationId, so a single
+// misbehaving destination's debug logging can be turned up via POST /log-level/{destinationId}
+// without restarting the whole app at DEBUG. StreamConsumer and AbstractBatchConsumer (and each of
+// its partition workers) build their own with NewDestinationLogger; Repository does not create or
+// inject one, and the bulker stream does not log through it.
+type DestinationLogger struct {
+	destinationId string
+}
+
+// NewDestinationLogger returns a DestinationLogger for destinationId.
+func NewDestinationLogger(destinationId string) *DestinationLogger {
+	return &DestinationLogger{destinationId: destinationId}
+}
+
+// Debugf logs at debug level, or at info level if destinationId currently has a "debug" log-level
+// override active, so the message is visible without the whole process running at DEBUG.
+func (l *DestinationLogger) Debugf(f Fields, format string, args ...any) {
+	msg := l.format(f, format, args...)
+	if logLevels.effective(l.destinationId) == "debug" {
+		logging.Infof("%s", msg)
+		return
+	}
+	logging.Debugf("%s", msg)
+}
+
+func (l *DestinationLogger) Infof(f Fields, format string, args ...any) {
+	logging.Infof("%s", l.format(f, format, args...))
+}
+
+func (l *DestinationLogger) Errorf(f Fields, format string, args ...any) {
+	logging.Errorf("%s", l.format(f, format, args...))
+}
+
+func (l *DestinationLogger) format(f Fields, format string, args ...any) string {
+	return fmt.Sprintf("[destination=%s %s] %s", l.destinationId, f, fmt.Sprintf(format, args...))
+}
+
+// logLevelRequest is the body of POST /log-level/{destinationId}.
+type logLevelRequest struct {
+	Level string `json:"level"`
+	TTL   string `json:"ttl"`
+}
+
+// RegisterLogLevelRoute wires POST /log-level/{destinationId} onto router. Called once from
+// Context.InitContext alongside the other HTTP subsystems.
+func RegisterLogLevelRoute(router *Router) {
+	router.Engine().POST("/log-level/:destinationId", func(c *gin.Context) {
+		destinationId := c.Param("destinationId")
+		var req logLevelRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid ttl: %v", err)})
+			return
+		}
+		logLevels.Set(destinationId, req.Level, ttl)
+		c.JSON(http.StatusOK, gin.H{"destinationId": destinationId, "level": req.Level, "ttl": ttl.String()})
+	})
+}
@@ -0,0 +1,353 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/gin-gonic/gin"
+	"github.com/jitsucom/bulker/bulkerapp/metrics"
+	"github.com/jitsucom/bulker/jitsubase/appbase"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const replayedAtHeader = "replayed_at"
+const dlqPeekTimeout = 5 * time.Second
+const dlqDefaultPeekLimit = 100
+
+// DeadLetterReplayer exposes HTTP endpoints to inspect, replay, and drain a destination's
+// dead-letter topic. Until this existed, messages written to the dead-letter topic by
+// StreamConsumer/RetryConsumer were effectively lost unless an operator built a custom tool to
+// read them back.
+type DeadLetterReplayer struct {
+	appbase.Service
+	config      *Config
+	kafkaConfig *kafka.ConfigMap
+	producer    *Producer
+}
+
+// NewDeadLetterReplayer registers the DLQ routes on router and returns the replayer. Called once
+// from Context.InitContext.
+func NewDeadLetterReplayer(config *Config, kafkaConfig *kafka.ConfigMap, producer *Producer, router *Router) *DeadLetterReplayer {
+	r := &DeadLetterReplayer{
+		Service:     appbase.NewServiceBase("dlq-replayer"),
+		config:      config,
+		kafkaConfig: kafkaConfig,
+		producer:    producer,
+	}
+	router.Engine().GET("/dlq/:destinationId", r.peek)
+	router.Engine().POST("/dlq/:destinationId/replay", r.replay)
+	router.Engine().DELETE("/dlq/:destinationId", r.drain)
+	return r
+}
+
+// dlqMessageView is the JSON representation of a peeked dead-letter message.
+type dlqMessageView struct {
+	Partition        int32               `json:"partition"`
+	Offset           int64               `json:"offset"`
+	Headers          map[string]string   `json:"headers"`
+	OriginalTopic    string              `json:"originalTopic"`
+	Error            string              `json:"error"`
+	ErrorStack       string              `json:"errorStack,omitempty"`
+	FirstFailureTime string              `json:"firstFailureTime,omitempty"`
+	RetryHistory     []RetryHistoryEntry `json:"retryHistory,omitempty"`
+}
+
+// dlqCursor identifies a single message within a (possibly multi-partition) dead-letter topic.
+// Offset alone isn't enough to disambiguate: two different messages on different partitions can
+// share the same offset.
+type dlqCursor struct {
+	Partition int32 `json:"partition"`
+	Offset    int64 `json:"offset"`
+}
+
+// parseDlqFrom parses the "from" query param of peek, formatted as comma-separated
+// "partition:offset" pairs (e.g. "0:100,1:50"), into a per-partition starting offset. A partition
+// absent from from has no lower bound.
+func parseDlqFrom(raw string) (map[int32]int64, error) {
+	from := make(map[int32]int64)
+	if raw == "" {
+		return from, nil
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid from cursor %q: expected partition:offset", pair)
+		}
+		partition, err := strconv.ParseInt(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from cursor %q: %v", pair, err)
+		}
+		offset, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from cursor %q: %v", pair, err)
+		}
+		from[int32(partition)] = offset
+	}
+	return from, nil
+}
+
+// peek handles GET /dlq/{destinationId}?limit=N&from=partition:offset,..., returning up to limit
+// messages currently sitting in the destination's dead-letter topic at or after the given
+// per-partition offset (if given), without consuming them (the transient consumer has its own
+// throwaway group with auto-commit disabled, so it never commits an offset).
+func (r *DeadLetterReplayer) peek(c *gin.Context) {
+	destinationId := c.Param("destinationId")
+	limit := dlqDefaultPeekLimit
+	if l, err := strconv.Atoi(c.Query("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	from, err := parseDlqFrom(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	topic, err := MakeTopicId(destinationId, deadTopicMode, allTablesToken, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	consumer, err := r.newPeekConsumer(topic)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer consumer.Close()
+
+	messages := make([]dlqMessageView, 0, limit)
+	for len(messages) < limit {
+		message, err := consumer.ReadMessage(dlqPeekTimeout)
+		if err != nil {
+			kafkaErr, ok := err.(kafka.Error)
+			if ok && kafkaErr.Code() == kafka.ErrTimedOut {
+				break
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if minOffset, ok := from[message.TopicPartition.Partition]; ok && int64(message.TopicPartition.Offset) < minOffset {
+			continue
+		}
+		messages = append(messages, toDlqMessageView(message))
+	}
+	c.JSON(http.StatusOK, gin.H{"destinationId": destinationId, "messages": messages})
+}
+
+// replayRequest selects which dead-letter messages to republish: either explicit (partition,
+// offset) pairs, or a time range matched against each message's retryTimeHeader/kafka timestamp.
+// All must be set explicitly to replay every message in the topic - an empty or malformed body
+// (e.g. {}) is rejected rather than silently falling back to "replay everything", since that
+// would republish a destination's whole dead-letter topic to production on a single typo'd
+// request. Offsets are pairs rather than bare offsets because dead-letter topics aren't
+// guaranteed single-partition, and two messages on different partitions can share an offset.
+type replayRequest struct {
+	Offsets []dlqCursor `json:"offsets"`
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	All     bool        `json:"all"`
+}
+
+// replay handles POST /dlq/{destinationId}/replay: re-publishes the selected dead-letter messages
+// back to their original topic (read from originalTopicHeader), resetting retriesCountHeader to 0
+// and stamping replayedAtHeader.
+func (r *DeadLetterReplayer) replay(c *gin.Context) {
+	destinationId := c.Param("destinationId")
+	var req replayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Offsets) == 0 && req.From == "" && req.To == "" && !req.All {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "must specify offsets, a from/to range, or all:true"})
+		return
+	}
+	topic, err := MakeTopicId(destinationId, deadTopicMode, allTablesToken, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	consumer, err := r.newPeekConsumer(topic)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer consumer.Close()
+
+	from, to, err := parseReplayRange(req.From, req.To)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	offsets := make(map[dlqCursor]bool, len(req.Offsets))
+	for _, o := range req.Offsets {
+		offsets[o] = true
+	}
+	byRange := len(offsets) == 0
+
+	replayed := 0
+	for {
+		message, err := consumer.ReadMessage(dlqPeekTimeout)
+		if err != nil {
+			kafkaErr, ok := err.(kafka.Error)
+			if ok && kafkaErr.Code() == kafka.ErrTimedOut {
+				break
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		cursor := dlqCursor{Partition: message.TopicPartition.Partition, Offset: int64(message.TopicPartition.Offset)}
+		if !byRange && !offsets[cursor] {
+			continue
+		}
+		if byRange {
+			retryTime, err := GetKafkaTimeHeader(message, retryTimeHeader)
+			if err != nil || retryTime.IsZero() {
+				retryTime = message.Timestamp
+			}
+			if (!from.IsZero() && retryTime.Before(from)) || (!to.IsZero() && retryTime.After(to)) {
+				continue
+			}
+		}
+		originalTopic := GetKafkaHeader(message, originalTopicHeader)
+		if originalTopic == "" {
+			continue
+		}
+		headers := replayHeaders(message)
+		err = r.producer.ProduceSync(originalTopic, kafka.Message{
+			Key:            message.Key,
+			TopicPartition: kafka.TopicPartition{Topic: &originalTopic, Partition: kafka.PartitionAny},
+			Headers:        headers,
+			Value:          message.Value,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to replay partition %d offset %d: %v", cursor.Partition, cursor.Offset, err)})
+			return
+		}
+		metrics.DLQReplayed(destinationId).Inc()
+		replayed++
+	}
+	c.JSON(http.StatusOK, gin.H{"destinationId": destinationId, "replayed": replayed})
+}
+
+// drain handles DELETE /dlq/{destinationId}: consumes and discards every message currently in the
+// destination's dead-letter topic, committing past them without replaying. Unlike peek/replay's
+// newPeekConsumer, drain uses a stable per-destination group.id (not one suffixed with the current
+// time) so its committed offsets persist across calls - otherwise every drain would start a brand
+// new group back at "earliest" and silently re-drain messages a previous call already passed,
+// making repeated DELETE calls a no-op. Kafka itself never deletes these messages; drain only
+// ever advances this one group's position past them.
+func (r *DeadLetterReplayer) drain(c *gin.Context) {
+	destinationId := c.Param("destinationId")
+	topic, err := MakeTopicId(destinationId, deadTopicMode, allTablesToken, false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	consumerConfig := kafka.ConfigMap{}
+	for k, v := range *r.kafkaConfig {
+		_ = consumerConfig.SetKey(k, v)
+	}
+	_ = consumerConfig.SetKey("group.id", fmt.Sprintf("dlq-drain-%s", destinationId))
+	_ = consumerConfig.SetKey("auto.offset.reset", "earliest")
+	_ = consumerConfig.SetKey("enable.auto.commit", true)
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer consumer.Close()
+	if err = consumer.SubscribeTopics([]string{topic}, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	drained := 0
+	for {
+		_, err := consumer.ReadMessage(dlqPeekTimeout)
+		if err != nil {
+			kafkaErr, ok := err.(kafka.Error)
+			if ok && kafkaErr.Code() == kafka.ErrTimedOut {
+				break
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		drained++
+	}
+	c.JSON(http.StatusOK, gin.H{"destinationId": destinationId, "drained": drained})
+}
+
+// newPeekConsumer returns a throwaway consumer with its own consumer group, positioned at the
+// earliest offset of topic, so concurrent peeks/replays don't interfere with each other or with
+// any long-running consumer.
+func (r *DeadLetterReplayer) newPeekConsumer(topic string) (*kafka.Consumer, error) {
+	consumerConfig := kafka.ConfigMap{}
+	for k, v := range *r.kafkaConfig {
+		_ = consumerConfig.SetKey(k, v)
+	}
+	_ = consumerConfig.SetKey("group.id", fmt.Sprintf("dlq-peek-%s-%d", topic, time.Now().UnixNano()))
+	_ = consumerConfig.SetKey("auto.offset.reset", "earliest")
+	_ = consumerConfig.SetKey("enable.auto.commit", false)
+	consumer, err := kafka.NewConsumer(&consumerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dlq consumer: %v", err)
+	}
+	if err = consumer.SubscribeTopics([]string{topic}, nil); err != nil {
+		_ = consumer.Close()
+		return nil, fmt.Errorf("failed to subscribe to dlq topic %s: %v", topic, err)
+	}
+	return consumer, nil
+}
+
+func toDlqMessageView(message *kafka.Message) dlqMessageView {
+	headers := make(map[string]string, len(message.Headers))
+	for _, h := range message.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	var history []RetryHistoryEntry
+	if raw := headers[retryHistoryHeader]; raw != "" {
+		_ = json.Unmarshal([]byte(raw), &history)
+	}
+	return dlqMessageView{
+		Partition:        message.TopicPartition.Partition,
+		Offset:           int64(message.TopicPartition.Offset),
+		Headers:          headers,
+		OriginalTopic:    headers[originalTopicHeader],
+		Error:            headers[errorMessageHeader],
+		ErrorStack:       headers[errorStackHeader],
+		FirstFailureTime: headers[firstFailureTimeHeader],
+		RetryHistory:     history,
+	}
+}
+
+func replayHeaders(message *kafka.Message) []kafka.Header {
+	headers := make([]kafka.Header, 0, len(message.Headers)+1)
+	for _, h := range message.Headers {
+		if h.Key == retriesCountHeader {
+			continue
+		}
+		headers = append(headers, h)
+	}
+	headers = append(headers, kafka.Header{Key: retriesCountHeader, Value: []byte("0")})
+	headers = append(headers, kafka.Header{Key: replayedAtHeader, Value: []byte(time.Now().UTC().Format(time.RFC3339))})
+	return headers
+}
+
+func parseReplayRange(from, to string) (time.Time, time.Time, error) {
+	var fromTime, toTime time.Time
+	var err error
+	if from != "" {
+		fromTime, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return fromTime, toTime, fmt.Errorf("invalid 'from': %v", err)
+		}
+	}
+	if to != "" {
+		toTime, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return fromTime, toTime, fmt.Errorf("invalid 'to': %v", err)
+		}
+	}
+	return fromTime, toTime, nil
+}
@@ -0,0 +1,50 @@
+package app
+
+// PartitionAssignor identifies the partition-assignment semantics a consumer group's topics are
+// expected to satisfy. It is a detector, not an assignment mechanism: librdkafka runs the actual
+// group protocol entirely on its own, chosen via KafkaConsumerPartitionsAssigmentStrategy
+// (range/roundrobin/cooperative-sticky), and confluent-kafka-go has no hook to plug a custom
+// assignor into it. The only thing PartitionAssignor is used for is naming the strategy
+// rebalanceCallback should check after the fact - "copartitioned" isn't a real librdkafka strategy,
+// so nothing here causes same-numbered partitions to land on the same member. Achieving that in
+// practice still requires giving every co-partitioned topic the same partition count and relying on
+// range/cooperative-sticky to keep numbering aligned; validateCopartitioning only detects when that
+// precondition is violated, it does not enforce it.
+type PartitionAssignor interface {
+	// Name identifies the strategy, matching the values accepted by CopartitioningStrategy.
+	Name() string
+}
+
+// NewPartitionAssignor resolves name to a built-in PartitionAssignor. Unknown names fall back to
+// rangeAssignor, matching librdkafka's own default.
+func NewPartitionAssignor(name string) PartitionAssignor {
+	switch name {
+	case "roundrobin":
+		return roundRobinAssignor{}
+	case "sticky":
+		return stickyAssignor{}
+	case "copartitioned":
+		return CopartitionedAssignor{}
+	default:
+		return rangeAssignor{}
+	}
+}
+
+type rangeAssignor struct{}
+
+func (rangeAssignor) Name() string { return "range" }
+
+type roundRobinAssignor struct{}
+
+func (roundRobinAssignor) Name() string { return "roundrobin" }
+
+type stickyAssignor struct{}
+
+func (stickyAssignor) Name() string { return "sticky" }
+
+// CopartitionedAssignor is the only PartitionAssignor that changes behavior: its Name() being
+// "copartitioned" is what rebalanceCallback checks to decide whether to run validateCopartitioning
+// after each rebalance (see PartitionAssignor's doc comment - this is detection, not enforcement).
+type CopartitionedAssignor struct{}
+
+func (CopartitionedAssignor) Name() string { return "copartitioned" }
@@ -4,148 +4,358 @@ import (
 	"context"
 	"fmt"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerapp/metrics"
 	"strconv"
 	"time"
 )
 
 type RetryConsumer struct {
 	*AbstractBatchConsumer
+	// transactional selects whether processBatchTransactional or processBatchNonTransactional
+	// backs batchFunc - see NewRetryConsumer.
+	transactional bool
+
+	// cron is the shared scheduler this consumer registers a tick on when config.RetryCron is
+	// set, instead of being driven by the regular fixed BatchPeriodSec interval. nil when no
+	// cron schedule applies.
+	cron *Cron
+	// unschedule stops this consumer's cron registration, if any - returned by Cron.AddFunc,
+	// called once from Close so no new tick can start once shutdown begins.
+	unschedule func()
 }
 
-func NewRetryConsumer(repository *Repository, destinationId string, batchPeriodSec int, topicId string, config *Config, kafkaConfig *kafka.ConfigMap) (*RetryConsumer, error) {
+func NewRetryConsumer(repository *Repository, destinationId string, batchPeriodSec int, topicId string, config *Config, kafkaConfig *kafka.ConfigMap, cron *Cron) (*RetryConsumer, error) {
 	base, err := NewAbstractBatchConsumer(repository, destinationId, batchPeriodSec, topicId, "retry", config, kafkaConfig)
 	if err != nil {
 		return nil, err
 	}
 	rc := RetryConsumer{
 		AbstractBatchConsumer: base,
+		transactional:         config.TransactionalRetry == nil || *config.TransactionalRetry,
+		cron:                  cron,
+	}
+	rc.transactionalProducers = rc.transactional
+	if rc.transactional {
+		rc.batchFunc = rc.processBatchTransactional
+	} else {
+		rc.batchFunc = rc.processBatchNonTransactional
 	}
-	rc.batchFunc = rc.processBatchImpl
 	rc.pause()
+	if rc.config.RetryCron != "" && rc.cron != nil {
+		rc.unschedule, err = rc.cron.AddFunc(rc.config.RetryCron, rc.RunJob)
+		if err != nil {
+			return nil, base.NewError("error registering retry cron schedule %q: %v", rc.config.RetryCron, err)
+		}
+	}
 	return &rc, nil
 }
 
-func (rc *RetryConsumer) processBatchImpl(_ *Destination, _, _, retryBatchSize int) (counters BatchCounters, nextBatch bool, err error) {
-	var firstPosition *kafka.TopicPartition
-	var lastPosition *kafka.TopicPartition
+// Close stops this consumer's cron registration, if any, before delegating to
+// AbstractBatchConsumer.Close, which waits for any tick currently running in ConsumeAll (whether
+// it was triggered by the cron schedule or not) to finish before closing the kafka consumer.
+// Unscheduling first guarantees no new tick can start once shutdown begins.
+func (rc *RetryConsumer) Close(ctx context.Context) error {
+	if rc.unschedule != nil {
+		rc.unschedule()
+	}
+	return rc.AbstractBatchConsumer.Close(ctx)
+}
+
+// RunJob skips a batch cycle when total lag across all assigned partitions is below
+// RetryMinLagToRun, so a destination whose retry topic is nearly caught up doesn't burn a batch
+// cycle (consumer resume/pause, transaction begin, watermark query) on an empty poll.
+func (rc *RetryConsumer) RunJob() {
+	if rc.config.RetryMinLagToRun > 0 && rc.totalLag() < rc.config.RetryMinLagToRun {
+		rc.logger.Debugf(Fields{Topic: rc.topicId}, "Skipping retry batch: lag %d below threshold %d", rc.totalLag(), rc.config.RetryMinLagToRun)
+		return
+	}
+	_, _ = rc.ConsumeAll()
+}
+
+// CronSchedule returns config.RetryCron, the cron expression (e.g. "*/5 * * * *") this retry
+// consumer was registered against in NewRetryConsumer, or "" if it's still driven by the regular
+// fixed BatchPeriodSec interval. RunJob itself doesn't change: each tick still unpauses, runs
+// batchFunc batches of up to retryBatchSize messages each until one reports no next batch, and
+// pauses again - only what triggers that tick differs. A tick is not limited to a single batch.
+func (rc *RetryConsumer) CronSchedule() string {
+	return rc.config.RetryCron
+}
+
+// retryRoute is the outcome of deciding what to do with a single message read off the retry topic:
+// produce it (with headers) to topic, accumulating counts.
+type retryRoute struct {
+	topic   string
+	headers []messaging.Header
+	counts  BatchCounters
+}
+
+// messageIntHeader parses message's header key as a decimal integer, mirroring GetKafkaIntHeader's
+// contract for the broker-agnostic *messaging.Message.
+func messageIntHeader(message *messaging.Message, key string) (int, error) {
+	value := message.Header(key)
+	if value == "" {
+		return 0, fmt.Errorf("header %s is missing", key)
+	}
+	return strconv.Atoi(value)
+}
+
+// messageTimeHeader parses message's header key as an RFC3339 timestamp, mirroring
+// GetKafkaTimeHeader's contract for the broker-agnostic *messaging.Message.
+func messageTimeHeader(message *messaging.Message, key string) (time.Time, error) {
+	value := message.Header(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// routeMessage decides whether message should be dead-lettered, requeued unchanged (not yet due
+// for retry) or bumped to another retry attempt and sent back to its original topic. ok is false
+// when the message's headers couldn't be parsed and it should be skipped entirely.
+func (rc *RetryConsumer) routeMessage(message *messaging.Message, consumedTopic string) (route retryRoute, ok bool) {
+	originalTopic := message.Header(originalTopicHeader)
+	topic := originalTopic
+	if topic == "" {
+		route.counts.skipped++
+		rc.logger.Errorf(Fields{Topic: consumedTopic, Partition: message.Partition, Offset: message.Offset}, "Failed to get original topic from message headers. Skipping message")
+		metrics.RetryMessages(rc.destinationId, "skipped").Inc()
+		return route, false
+	}
+	rc.logger.Debugf(Fields{Topic: consumedTopic, Partition: message.Partition, Offset: message.Offset}, "message %d header: %v", message.Offset, message.Headers)
+	retries, err := messageIntHeader(message, retriesCountHeader)
+	if err != nil {
+		route.counts.skipped++
+		rc.logger.Errorf(Fields{Topic: consumedTopic, Partition: message.Partition, Offset: message.Offset}, "Failed to get retries count from message headers. Skipping message")
+		metrics.RetryMessages(rc.destinationId, "skipped").Inc()
+		return route, false
+	}
+	headers := make([]messaging.Header, 0, len(message.Headers))
+	permanent := message.Header(permanentErrorHeader) == "true"
+	errorMessage := message.Header(errorMessageHeader)
+	errorStack := message.Header(errorStackHeader)
+	firstFailureTime := message.Header(firstFailureTimeHeader)
+	if permanent || retries >= rc.config.MessagesRetryCount {
+		route.counts.deadLettered++
+		//no attempts left, or the error was marked permanent upstream - send to dead-letter topic
+		topic, _ = MakeTopicId(rc.destinationId, deadTopicMode, allTablesToken, false)
+		if permanent {
+			headers = append(headers, messaging.Header{Key: permanentErrorHeader, Value: []byte("true")})
+		}
+		metrics.RetryMessages(rc.destinationId, "dead_lettered").Inc()
+	} else if !rc.isTimeToRetry(message) {
+		route.counts.notReadyReadded++
+		// retry time is not yet come. requeueing message
+		topic = consumedTopic
+		headers = append(headers, messaging.Header{Key: retryTimeHeader, Value: []byte(message.Header(retryTimeHeader))})
+		headers = append(headers, messaging.Header{Key: retryDelayHeader, Value: []byte(message.Header(retryDelayHeader))})
+		metrics.RetryMessages(rc.destinationId, "not_ready_readded").Inc()
+	} else {
+		retries++
+		route.counts.retryScheduled++
+		metrics.RetryMessages(rc.destinationId, "retry_scheduled").Inc()
+	}
+	metrics.RetryAttempts(rc.destinationId).Observe(float64(retries))
+	headers = append(headers, messaging.Header{Key: originalTopicHeader, Value: []byte(originalTopic)})
+	headers = append(headers, messaging.Header{Key: retriesCountHeader, Value: []byte(strconv.Itoa(retries))})
+	// errorMessage was written by StreamConsumer when the message last failed, firstFailureTime when
+	// it first failed, and errorStack only if an earlier hop set it; all three are carried forward
+	// unchanged through the retry topic. retryHistoryHeader gets a new entry for each hop so the whole failure timeline survives
+	// until the message either succeeds or reaches the dead-letter topic.
+	if errorMessage != "" {
+		headers = append(headers, messaging.Header{Key: errorMessageHeader, Value: []byte(errorMessage)})
+	}
+	if errorStack != "" {
+		headers = append(headers, messaging.Header{Key: errorStackHeader, Value: []byte(errorStack)})
+	}
+	if firstFailureTime != "" {
+		headers = append(headers, messaging.Header{Key: firstFailureTimeHeader, Value: []byte(firstFailureTime)})
+	}
+	headers = append(headers, messaging.Header{Key: retryHistoryHeader, Value: []byte(appendRetryHistory(message.Header(retryHistoryHeader), RetryHistoryEntry{Attempt: retries, Time: time.Now().UTC(), Error: errorMessage}))})
+	route.topic = topic
+	route.headers = headers
+	return route, true
+}
+
+// processBatchTransactional drains up to retryBatchSize messages from partition's queue, decides
+// for each whether to dead-letter it, requeue it unchanged (not yet due for retry) or bump its
+// retry count and send it back to the original topic, and commits the partition's offset
+// atomically with the producer transaction via partitionProducer - never the whole assignment's
+// offsets.
+func (rc *RetryConsumer) processBatchTransactional(_ *Destination, consumedTopic string, partition messaging.TopicPartition, _ int, messages <-chan *messaging.Message, partitionProducer messaging.TransactionalProducer, _, retryBatchSize int) (counters BatchCounters, nextBatch bool, err error) {
+	batchStart := time.Now()
+	defer func() { metrics.RetryBatchDuration(rc.destinationId).Observe(time.Since(batchStart).Seconds()) }()
+	var firstPosition *messaging.TopicPartition
+	var lastPosition *messaging.TopicPartition
 
 	txOpened := false
 	defer func() {
 		if err != nil {
 			//cleanup
 			if firstPosition != nil {
-				_, _ = rc.consumer.Load().SeekPartitions([]kafka.TopicPartition{*firstPosition})
+				_ = rc.client().SeekPartitions([]messaging.TopicPartition{*firstPosition})
 			}
 			if txOpened {
-				_ = rc.producer.AbortTransaction(context.Background())
+				_ = partitionProducer.AbortTransaction(context.Background())
 			}
 			nextBatch = false
 		}
 	}()
-	_, highOffset, err := rc.consumer.Load().QueryWatermarkOffsets(rc.topicId, 0, 10_000)
+	_, highOffset, err := rc.client().QueryWatermarkOffsets(consumedTopic, partition.Partition, 10_000*time.Millisecond)
+	if err != nil {
+		return BatchCounters{}, false, err
+	}
 
 	nextBatch = true
 	for i := 0; i < retryBatchSize; i++ {
 		if rc.retired.Load() {
 			return
 		}
-		if lastPosition != nil && int64(lastPosition.Offset) == highOffset-1 {
+		if lastPosition != nil && lastPosition.Offset == highOffset-1 {
 			nextBatch = false
-			rc.Debugf("Reached watermark offset %d. Stopping batch", highOffset-1)
-			// we reached the end of the topic
+			rc.logger.Debugf(Fields{Topic: consumedTopic, Partition: partition.Partition}, "Reached watermark offset %d on partition %d. Stopping batch", highOffset-1, partition.Partition)
+			// we reached the end of the partition
 			break
 		}
-		message, err := rc.consumer.Load().ReadMessage(rc.waitForMessages)
-		if err != nil {
-			kafkaErr := err.(kafka.Error)
-			if kafkaErr.Code() == kafka.ErrTimedOut {
+		var message *messaging.Message
+		select {
+		case message = <-messages:
+			if message == nil {
+				// partition revoked mid-batch; its queue was closed
 				nextBatch = false
-				// waitForMessages period is over. it's ok. considering batch as full
-				break
+				return
 			}
-			return BatchCounters{}, false, rc.NewError("Failed to consume event from topic. Retryable: %t: %v", kafkaErr.IsRetriable(), kafkaErr)
+		case <-time.After(rc.waitForMessages):
+			nextBatch = false
+			// waitForMessages period is over. it's ok. considering batch as full
+			goto batchFull
 		}
 		counters.consumed++
-		lastPosition = &message.TopicPartition
+		position := messaging.TopicPartition{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset}
+		lastPosition = &position
 		if counters.consumed == 1 {
-			firstPosition = &message.TopicPartition
-			err = rc.producer.BeginTransaction()
+			firstPosition = &position
+			err = partitionProducer.BeginTransaction()
 			if err != nil {
 				return BatchCounters{}, false, fmt.Errorf("failed to begin kafka transaction: %v", err)
 			}
 			txOpened = true
 		}
-		singleCount := BatchCounters{}
-		originalTopic := GetKafkaHeader(message, originalTopicHeader)
-		topic := originalTopic
-		if topic == "" {
-			singleCount.skipped++
-			rc.Errorf("Failed to get original topic from message headers. Skipping message")
+		route, ok := rc.routeMessage(message, consumedTopic)
+		if !ok {
+			counters.accumulate(route.counts)
 			continue
 		}
-		rc.Debugf("message %s header: %v", message.TopicPartition.Offset, message.Headers)
-		retries, err := GetKafkaIntHeader(message, retriesCountHeader)
-		if err != nil {
-			singleCount.skipped++
-			rc.Errorf("Failed to get retries count from message headers. Skipping message")
-			continue
-		}
-		headers := make([]kafka.Header, 0, len(message.Headers))
-		if retries >= rc.config.MessagesRetryCount {
-			singleCount.deadLettered++
-			//no attempts left - send to dead-letter topic
-			topic, _ = MakeTopicId(rc.destinationId, deadTopicMode, allTablesToken, false)
-		} else if !rc.isTimeToRetry(message) {
-			singleCount.notReadyReadded++
-			// retry time is not yet come. requeueing message
-			topic = rc.topicId
-			headers = append(headers, kafka.Header{Key: retryTimeHeader, Value: []byte(GetKafkaHeader(message, retryTimeHeader))})
-		} else {
-			retries++
-			singleCount.retryScheduled++
-		}
-		headers = append(headers, kafka.Header{Key: originalTopicHeader, Value: []byte(originalTopic)})
-		headers = append(headers, kafka.Header{Key: retriesCountHeader, Value: []byte(strconv.Itoa(retries))})
-		err = rc.producer.Produce(&kafka.Message{
-			Key:            message.Key,
-			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
-			Headers:        headers,
-			Value:          message.Value,
-		}, nil)
+		err = partitionProducer.Produce(&messaging.Message{
+			Topic:   route.topic,
+			Key:     message.Key,
+			Value:   message.Value,
+			Headers: route.headers,
+		})
 		if err != nil {
 			return counters, false, fmt.Errorf("failed to put message to producer: %v", err)
 		}
-		counters.accumulate(singleCount)
+		counters.accumulate(route.counts)
 
 	}
+batchFull:
 	if !txOpened {
 		return
 	}
-	groupMetadata, err := rc.consumer.Load().GetConsumerGroupMetadata()
+	groupMetadata, err := rc.client().GroupMetadata()
 	if err != nil {
 		return BatchCounters{}, false, fmt.Errorf("failed to get consumer group metadata: %v", err)
 	}
 	offset := *lastPosition
 	offset.Offset++
-	//set consumer offset to the next message after failure. that happens atomically with whole producer transaction
-	err = rc.producer.SendOffsetsToTransaction(context.Background(), []kafka.TopicPartition{offset}, groupMetadata)
+	//set consumer offset to the next message after failure on this partition only. that happens
+	//atomically with whole producer transaction
+	err = partitionProducer.SendOffsetsToTransaction(context.Background(), []messaging.TopicPartition{offset}, groupMetadata)
 	if err != nil {
 		return BatchCounters{}, false, fmt.Errorf("failed to send consumer offset to producer transaction: %v", err)
 	}
-	err = rc.producer.CommitTransaction(context.Background())
+	err = partitionProducer.CommitTransaction(context.Background())
 	if err != nil {
 		return BatchCounters{}, false, fmt.Errorf("failed to commit kafka transaction for producer: %v", err)
 	}
 	return
 }
 
-func (rc *RetryConsumer) isTimeToRetry(message *kafka.Message) bool {
-	retryTime, err := GetKafkaTimeHeader(message, retryTimeHeader)
+// processBatchNonTransactional drains up to retryBatchSize messages from partition's queue,
+// routing each the same way processBatchTransactional does, but producing and committing its
+// consumer offset one message at a time instead of wrapping the whole batch in a producer
+// transaction - so a transient error on one message only requires replaying that message, never
+// the whole in-flight batch. This trades at-least-once duplicate risk (a crash between produce ack
+// and offset commit redelivers that one message) for lower tail latency on destinations that can
+// tolerate duplicates.
+func (rc *RetryConsumer) processBatchNonTransactional(_ *Destination, consumedTopic string, partition messaging.TopicPartition, _ int, messages <-chan *messaging.Message, partitionProducer messaging.TransactionalProducer, _, retryBatchSize int) (counters BatchCounters, nextBatch bool, err error) {
+	batchStart := time.Now()
+	defer func() { metrics.RetryBatchDuration(rc.destinationId).Observe(time.Since(batchStart).Seconds()) }()
+	_, highOffset, err := rc.client().QueryWatermarkOffsets(consumedTopic, partition.Partition, 10_000*time.Millisecond)
+	if err != nil {
+		return BatchCounters{}, false, err
+	}
+
+	nextBatch = true
+	var lastPosition *messaging.TopicPartition
+	for i := 0; i < retryBatchSize; i++ {
+		if rc.retired.Load() {
+			return
+		}
+		if lastPosition != nil && lastPosition.Offset == highOffset-1 {
+			nextBatch = false
+			rc.logger.Debugf(Fields{Topic: consumedTopic, Partition: partition.Partition}, "Reached watermark offset %d on partition %d. Stopping batch", highOffset-1, partition.Partition)
+			break
+		}
+		var message *messaging.Message
+		select {
+		case message = <-messages:
+			if message == nil {
+				// partition revoked mid-batch; its queue was closed
+				nextBatch = false
+				return
+			}
+		case <-time.After(rc.waitForMessages):
+			nextBatch = false
+			// waitForMessages period is over. it's ok. considering batch as full
+			return
+		}
+		counters.consumed++
+		position := messaging.TopicPartition{Topic: message.Topic, Partition: message.Partition, Offset: message.Offset}
+		lastPosition = &position
+
+		route, ok := rc.routeMessage(message, consumedTopic)
+		if !ok {
+			counters.accumulate(route.counts)
+			continue
+		}
+		err = partitionProducer.ProduceSync(&messaging.Message{
+			Topic:   route.topic,
+			Key:     message.Key,
+			Value:   message.Value,
+			Headers: route.headers,
+		})
+		if err != nil {
+			return counters, false, fmt.Errorf("failed to deliver message to %s: %v", route.topic, err)
+		}
+		offset := position
+		offset.Offset++
+		if err = rc.client().CommitOffsets([]messaging.TopicPartition{offset}); err != nil {
+			return counters, false, fmt.Errorf("failed to commit consumer offset: %v", err)
+		}
+		counters.accumulate(route.counts)
+	}
+	return
+}
+
+func (rc *RetryConsumer) isTimeToRetry(message *messaging.Message) bool {
+	retryTime, err := messageTimeHeader(message, retryTimeHeader)
 	if err != nil {
-		rc.Errorf("failed to parse retry_time: %v", err)
+		rc.logger.Errorf(Fields{Topic: rc.topicId, Partition: message.Partition, Offset: message.Offset}, "failed to parse retry_time: %v", err)
 		return true
 	}
 	if retryTime.IsZero() || time.Now().After(retryTime) {
+		metrics.RetryDelay(rc.destinationId).Observe(time.Since(message.Timestamp).Seconds())
 		return true
 	}
 	return false
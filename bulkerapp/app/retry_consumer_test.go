@@ -0,0 +1,151 @@
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+)
+
+// errTestDelivery is the injected delivery failure
+// TestRetryConsumerProcessBatchNonTransactionalPartialFailure configures
+// InMemoryTransactionalProducer to return for one message in the batch.
+var errTestDelivery = errors.New("test: simulated delivery failure")
+
+// TestRetryConsumerRouteMessagePartialFailures exercises routeMessage's per-message routing
+// decisions in isolation from any broker: a permanently-failed message and one that exhausted its
+// retry budget both go to the dead-letter topic, one not yet due for retry is requeued unchanged,
+// and one that's eligible and due gets bumped to another attempt against its original topic. This
+// is the partial-failure routing that chunk2-1's non-transactional mode relies on being correct
+// per-message, since it commits each message individually instead of aborting a whole batch.
+func TestRetryConsumerRouteMessagePartialFailures(t *testing.T) {
+	rc := &RetryConsumer{
+		AbstractBatchConsumer: &AbstractBatchConsumer{
+			destinationId: "dest1",
+			config:        &Config{MessagesRetryCount: 2},
+			logger:        NewDestinationLogger("dest1"),
+		},
+	}
+
+	newMessage := func(headers ...messaging.Header) *messaging.Message {
+		return &messaging.Message{Offset: 1, Headers: headers}
+	}
+
+	t.Run("permanent error is dead-lettered", func(t *testing.T) {
+		message := newMessage(
+			messaging.Header{Key: originalTopicHeader, Value: []byte("orig")},
+			messaging.Header{Key: retriesCountHeader, Value: []byte("0")},
+			messaging.Header{Key: permanentErrorHeader, Value: []byte("true")},
+		)
+		route, ok := rc.routeMessage(message, "retry-topic")
+		if !ok || route.counts.deadLettered != 1 {
+			t.Fatalf("expected a dead-lettered message, got ok=%t counts=%+v", ok, route.counts)
+		}
+	})
+
+	t.Run("retries exhausted is dead-lettered", func(t *testing.T) {
+		message := newMessage(
+			messaging.Header{Key: originalTopicHeader, Value: []byte("orig")},
+			messaging.Header{Key: retriesCountHeader, Value: []byte("2")},
+		)
+		route, ok := rc.routeMessage(message, "retry-topic")
+		if !ok || route.counts.deadLettered != 1 {
+			t.Fatalf("expected a dead-lettered message, got ok=%t counts=%+v", ok, route.counts)
+		}
+	})
+
+	t.Run("not yet due is requeued unchanged", func(t *testing.T) {
+		message := newMessage(
+			messaging.Header{Key: originalTopicHeader, Value: []byte("orig")},
+			messaging.Header{Key: retriesCountHeader, Value: []byte("0")},
+			messaging.Header{Key: retryTimeHeader, Value: []byte(time.Now().Add(time.Hour).UTC().Format(time.RFC3339))},
+			messaging.Header{Key: retryDelayHeader, Value: []byte("3600000")},
+		)
+		route, ok := rc.routeMessage(message, "retry-topic")
+		if !ok || route.counts.notReadyReadded != 1 || route.topic != "retry-topic" {
+			t.Fatalf("expected a requeue to retry-topic, got ok=%t topic=%q counts=%+v", ok, route.topic, route.counts)
+		}
+		forwarded := &messaging.Message{Headers: route.headers}
+		if got := forwarded.Header(retryDelayHeader); got != "3600000" {
+			t.Fatalf("expected retryDelayHeader to be forwarded unchanged, got %q", got)
+		}
+	})
+
+	t.Run("due for retry is bumped and sent to its original topic", func(t *testing.T) {
+		message := newMessage(
+			messaging.Header{Key: originalTopicHeader, Value: []byte("orig")},
+			messaging.Header{Key: retriesCountHeader, Value: []byte("0")},
+		)
+		route, ok := rc.routeMessage(message, "retry-topic")
+		if !ok || route.counts.retryScheduled != 1 || route.topic != "orig" {
+			t.Fatalf("expected a retry bump to orig, got ok=%t topic=%q counts=%+v", ok, route.topic, route.counts)
+		}
+	})
+
+	t.Run("missing original topic header is skipped", func(t *testing.T) {
+		message := newMessage(messaging.Header{Key: retriesCountHeader, Value: []byte("0")})
+		_, ok := rc.routeMessage(message, "retry-topic")
+		if ok {
+			t.Fatalf("expected ok=false when original topic header is missing")
+		}
+	})
+}
+
+// TestRetryConsumerProcessBatchNonTransactionalPartialFailure drives processBatchNonTransactional
+// through an InMemoryBatchClient/InMemoryTransactionalProducer with 3 messages in the batch, the
+// second of which fails to deliver: it asserts the first message's consumer offset was committed
+// before the failure was hit, and that the batch stops (returning an error) rather than attempting
+// the third message - demonstrating the actual benefit non-transactional mode claims over the
+// transactional path, which would instead abort and redeliver the whole batch.
+func TestRetryConsumerProcessBatchNonTransactionalPartialFailure(t *testing.T) {
+	client := messaging.NewInMemoryBatchClient()
+	bc := &AbstractBatchConsumer{
+		destinationId:   "dest1",
+		config:          &Config{MessagesRetryCount: 5},
+		logger:          NewDestinationLogger("dest1"),
+		waitForMessages: 50 * time.Millisecond,
+	}
+	var c messaging.BatchClient = client
+	bc.consumer.Store(&c)
+	rc := &RetryConsumer{AbstractBatchConsumer: bc}
+
+	const consumedTopic = "retry-topic"
+	const partitionNum = int32(0)
+	client.SetWatermark(partitionNum, 100)
+
+	producer := messaging.NewInMemoryTransactionalProducer(false)
+	producer.FailProduceForKey("msg2", errTestDelivery)
+
+	messages := make(chan *messaging.Message, 3)
+	newMsg := func(key string, offset int64) *messaging.Message {
+		return &messaging.Message{
+			Topic: consumedTopic, Partition: partitionNum, Offset: offset,
+			Key: []byte(key),
+			Headers: []messaging.Header{
+				{Key: originalTopicHeader, Value: []byte("orig-topic")},
+				{Key: retriesCountHeader, Value: []byte("0")},
+			},
+		}
+	}
+	messages <- newMsg("msg1", 10)
+	messages <- newMsg("msg2", 11)
+	messages <- newMsg("msg3", 12)
+	close(messages)
+
+	counters, nextBatch, err := rc.processBatchNonTransactional(nil, consumedTopic, messaging.TopicPartition{Topic: consumedTopic, Partition: partitionNum}, 1, messages, producer, 10, 10)
+	if err == nil {
+		t.Fatalf("expected an error from the failed second message, got nil (counters=%+v nextBatch=%t)", counters, nextBatch)
+	}
+	if counters.consumed != 2 {
+		t.Fatalf("expected exactly 2 messages consumed before the batch stopped, got %d", counters.consumed)
+	}
+	committedOffset, ok := client.CommittedOffset(partitionNum)
+	if !ok || committedOffset != 11 {
+		t.Fatalf("expected the offset after the first message (11) to remain committed despite the later failure, got ok=%t offset=%d", ok, committedOffset)
+	}
+	produced := producer.Produced()
+	if len(produced) != 1 || string(produced[0].Key) != "msg1" {
+		t.Fatalf("expected only msg1 to have been produced before the batch stopped, got %+v", produced)
+	}
+}
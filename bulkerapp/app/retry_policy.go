@@ -0,0 +1,58 @@
+package app
+
+import (
+	"encoding/json"
+	bulker "github.com/jitsucom/bulker/bulkerlib"
+	"time"
+)
+
+// permanentErrorHeader marks a message in the retry/dead-letter topics as having failed with an
+// error that retrying will never fix (e.g. the payload itself is malformed), so RetryConsumer
+// sends it straight to the dead-letter topic instead of burning through MessagesRetryCount
+// redelivery attempts on a poison message.
+const permanentErrorHeader = "x-permanent-error"
+
+// errorMessageHeader, errorStackHeader, firstFailureTimeHeader and retryHistoryHeader preserve why
+// a message ended up in the retry/dead-letter pipeline, so it can actually be debugged once it
+// lands there instead of just showing up with a bumped retries count. StreamConsumer overwrites
+// errorMessageHeader with the latest failure every time it fails the message, sets
+// firstFailureTimeHeader only on the first failure, and adds an entry to retryHistoryHeader via
+// appendRetryHistory below. errorStackHeader is carried forward when present; StreamConsumer does
+// not set it.
+const errorMessageHeader = "x-error-message"
+const errorStackHeader = "x-error-stack"
+const firstFailureTimeHeader = "x-first-failure-time"
+const retryHistoryHeader = "x-retry-history"
+
+// RetryHistoryEntry records one failed-delivery attempt for a message moving through the
+// retry/dead-letter pipeline. retryHistoryHeader carries a JSON array of these, oldest first.
+type RetryHistoryEntry struct {
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	Error   string    `json:"error"`
+}
+
+// appendRetryHistory decodes existing (a message's current retryHistoryHeader value, "" if unset
+// or this is the message's first failure), appends entry, and returns the re-encoded JSON array.
+// A malformed existing value is treated as empty rather than failing the caller's produce.
+func appendRetryHistory(existing string, entry RetryHistoryEntry) string {
+	var history []RetryHistoryEntry
+	if existing != "" {
+		_ = json.Unmarshal([]byte(existing), &history)
+	}
+	history = append(history, entry)
+	encoded, err := json.Marshal(history)
+	if err != nil {
+		return existing
+	}
+	return string(encoded)
+}
+
+// RetryBackOffDelay returns the delay before a message that has already been redelivered `retries`
+// times (its retriesCountHeader value) should be redelivered again, per destination's RetryPolicyOption (bulker.DefaultRetryPolicy
+// if unset). Callers that stamp retryTimeHeader with time.Now().Add(delay) also stamp
+// retryDelayHeader with the delay itself, for observability.
+func RetryBackOffDelay(destination *Destination, retries int) time.Duration {
+	policy := bulker.RetryPolicyOption.Get(destination.streamOptions)
+	return policy.NextDelay(retries)
+}
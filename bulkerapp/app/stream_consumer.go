@@ -1,68 +1,77 @@
 package app
 
 import (
-	"bytes"
 	"context"
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/jitsucom/bulker/bulkerapp/decoders"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
 	"github.com/jitsucom/bulker/bulkerapp/metrics"
 	bulker "github.com/jitsucom/bulker/bulkerlib"
 	"github.com/jitsucom/bulker/bulkerlib/types"
 	"github.com/jitsucom/bulker/jitsubase/appbase"
 	"github.com/jitsucom/bulker/jitsubase/safego"
 	"github.com/jitsucom/bulker/jitsubase/timestamp"
-	"github.com/jitsucom/bulker/jitsubase/utils"
-	jsoniter "github.com/json-iterator/go"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 const streamConsumerMessageWaitTimeout = 1 * time.Second
 
+// streamConsumerRestartInterval is how often restartConsumer retries building a fresh client
+// after the previous one failed. A package-level var rather than an inline literal so tests can
+// shrink it instead of waiting out the real interval.
+var streamConsumerRestartInterval = 10 * time.Second
+
+// streamConsumerCloseTimeout bounds how long Close(ctx) waits for the in-flight bulker stream
+// to Complete/Abort once the consumer loop has stopped reading new messages.
+const streamConsumerCloseTimeout = 10 * time.Second
+
 type StreamConsumer struct {
 	appbase.Service
-	config         *Config
-	repository     *Repository
-	destination    *Destination
-	stream         atomic.Pointer[bulker.BulkerStream]
-	consumerConfig kafka.ConfigMap
-	consumer       *kafka.Consumer
+	config        *Config
+	repository    *Repository
+	destination   *Destination
+	stream        atomic.Pointer[bulker.BulkerStream]
+	clientFactory messaging.Factory
+	consumer      messaging.Client
 
 	bulkerProducer   *Producer
 	eventsLogService EventsLogService
+	logger           *DestinationLogger
 
 	topicId   string
 	tableName string
 
 	closed chan struct{}
+	// wg is released once the consumer loop has committed or aborted its current message and
+	// completed the bulker stream, so Close(ctx) can wait for a clean drain instead of tearing
+	// the stream down mid-flight.
+	wg sync.WaitGroup
 }
 
-func NewStreamConsumer(repository *Repository, destination *Destination, topicId string, config *Config, kafkaConfig *kafka.ConfigMap, bulkerProducer *Producer, eventsLogService EventsLogService) (*StreamConsumer, error) {
+// NewStreamConsumer builds a StreamConsumer. clientFactory builds the messaging.Client the
+// consumer reads from (and rebuilds from on restartConsumer); production callers back it with a
+// confluent-kafka-go client via messaging.NewConsumer, tests can back it with
+// messaging.NewInMemoryClient.
+func NewStreamConsumer(repository *Repository, destination *Destination, topicId string, config *Config, clientFactory messaging.Factory, bulkerProducer *Producer, eventsLogService EventsLogService) (*StreamConsumer, error) {
 	base := appbase.NewServiceBase(topicId)
 	_, _, tableName, err := ParseTopicId(topicId)
 	if err != nil {
 		metrics.ConsumerErrors(topicId, "stream", "INVALID_TOPIC", "INVALID_TOPIC:"+topicId, "failed to parse topic").Inc()
 		return nil, base.NewError("Failed to parse topic: %v", err)
 	}
-	consumerConfig := kafka.ConfigMap(utils.MapPutAll(kafka.ConfigMap{
-		"group.id":                      topicId,
-		"auto.offset.reset":             "earliest",
-		"group.instance.id":             config.InstanceId,
-		"partition.assignment.strategy": config.KafkaConsumerPartitionsAssigmentStrategy,
-		"enable.auto.commit":            true,
-		"isolation.level":               "read_committed",
-	}, *kafkaConfig))
-
-	consumer, err := kafka.NewConsumer(&consumerConfig)
+	consumer, err := clientFactory()
 	if err != nil {
-		metrics.ConsumerErrors(topicId, "stream", destination.Id(), tableName, metrics.KafkaErrorCode(err)).Inc()
-		return nil, base.NewError("Error creating kafka consumer: %v", err)
+		metrics.ConsumerErrors(topicId, "stream", destination.Id(), tableName, "client_factory_error").Inc()
+		return nil, base.NewError("Error creating messaging client: %v", err)
 	}
 
 	err = consumer.SubscribeTopics([]string{topicId}, nil)
 	if err != nil {
 		_ = consumer.Close()
-		metrics.ConsumerErrors(topicId, "stream", destination.Id(), tableName, metrics.KafkaErrorCode(err)).Inc()
+		metrics.ConsumerErrors(topicId, "stream", destination.Id(), tableName, consumer.Code(err)).Inc()
 		return nil, base.NewError("Failed to subscribe to topic: %v", err)
 	}
 
@@ -78,10 +87,11 @@ func NewStreamConsumer(repository *Repository, destination *Destination, topicId
 		destination:      destination,
 		topicId:          topicId,
 		tableName:        tableName,
-		consumerConfig:   consumerConfig,
+		clientFactory:    clientFactory,
 		consumer:         consumer,
 		bulkerProducer:   bulkerProducer,
 		eventsLogService: eventsLogService,
+		logger:           NewDestinationLogger(destination.Id()),
 		closed:           make(chan struct{}),
 	}
 	bulkerStream, err := sc.destination.bulker.CreateStream(sc.topicId, sc.tableName, bulker.Stream, sc.destination.streamOptions.Options...)
@@ -96,34 +106,35 @@ func NewStreamConsumer(repository *Repository, destination *Destination, topicId
 }
 
 func (sc *StreamConsumer) restartConsumer() {
-	sc.Infof("Restarting consumer")
-	go func(c *kafka.Consumer) {
+	restartFields := Fields{Topic: sc.topicId}
+	sc.logger.Infof(restartFields, "Restarting consumer")
+	go func(c messaging.Client) {
 		err := c.Close()
-		sc.Infof("Previous consumer closed: %v", err)
+		sc.logger.Infof(restartFields, "Previous consumer closed: %v", err)
 	}(sc.consumer)
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := time.NewTicker(streamConsumerRestartInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-sc.closed:
 			return
 		case <-ticker.C:
-			sc.Infof("Restarting consumer")
-			consumer, err := kafka.NewConsumer(&sc.consumerConfig)
+			sc.logger.Infof(restartFields, "Restarting consumer")
+			consumer, err := sc.clientFactory()
 			if err != nil {
-				metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, metrics.KafkaErrorCode(err)).Inc()
-				sc.Errorf("Error creating kafka consumer: %v", err)
+				metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "client_factory_error").Inc()
+				sc.logger.Errorf(restartFields, "Error creating messaging client: %v", err)
 				break
 			}
 			err = consumer.SubscribeTopics([]string{sc.topicId}, nil)
 			if err != nil {
-				metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, metrics.KafkaErrorCode(err)).Inc()
+				metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, consumer.Code(err)).Inc()
 				_ = consumer.Close()
-				sc.Errorf("Failed to subscribe to topic: %v", err)
+				sc.logger.Errorf(restartFields, "Failed to subscribe to topic: %v", err)
 				break
 			}
 			sc.consumer = consumer
-			sc.Infof("Restarted successfully")
+			sc.logger.Infof(restartFields, "Restarted successfully")
 			return
 		}
 	}
@@ -132,29 +143,32 @@ func (sc *StreamConsumer) restartConsumer() {
 // start consuming messages from kafka
 func (sc *StreamConsumer) start() {
 	sc.Infof("Starting stream consumer for topic. Ver: %s", sc.destination.config.UpdatedAt)
+	sc.wg.Add(1)
 	safego.RunWithRestart(func() {
+		defer sc.wg.Done()
 		var err error
 		for {
 			select {
 			case <-sc.closed:
 				_ = sc.consumer.Close()
 				var state bulker.State
+				completeCtx, cancel := context.WithTimeout(context.Background(), streamConsumerCloseTimeout)
 				if err != nil {
-					state, _ = (*sc.stream.Load()).Abort(context.Background())
+					state, _ = (*sc.stream.Load()).Abort(completeCtx)
 				} else {
-					state, _ = (*sc.stream.Load()).Complete(context.Background())
+					state, _ = (*sc.stream.Load()).Complete(completeCtx)
 				}
+				cancel()
 				sc.Infof("Closed stream state: %+v", state)
 				return
 			default:
-				var message *kafka.Message
+				var message *messaging.Message
 				message, err = sc.consumer.ReadMessage(streamConsumerMessageWaitTimeout)
 				if err != nil {
-					kafkaErr := err.(kafka.Error)
-					if kafkaErr.Code() != kafka.ErrTimedOut {
-						metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, metrics.KafkaErrorCode(kafkaErr)).Inc()
-						sc.Errorf("Error reading message from topic: %v retriable: %t", kafkaErr, kafkaErr.IsRetriable())
-						if kafkaErr.IsRetriable() {
+					if !sc.consumer.IsTimeout(err) {
+						metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, sc.consumer.Code(err)).Inc()
+						sc.logger.Errorf(Fields{Topic: sc.topicId}, "Error reading message from topic: %v retriable: %t", err, sc.consumer.IsRetriable(err))
+						if sc.consumer.IsRetriable(err) {
 							time.Sleep(streamConsumerMessageWaitTimeout * 10)
 						} else {
 							sc.restartConsumer()
@@ -163,51 +177,75 @@ func (sc *StreamConsumer) start() {
 					continue
 				}
 				metrics.ConsumerMessages(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "consumed").Inc()
-				obj := types.Object{}
-				dec := jsoniter.NewDecoder(bytes.NewReader(message.Value))
-				dec.UseNumber()
-				err = dec.Decode(&obj)
+				decoderName := bulker.DecoderOption.Get(sc.destination.streamOptions)
+				var obj types.Object
+				// decode errors are permanent: retrying a message that can't be parsed will never
+				// succeed, so it is sent straight to the dead-letter topic below instead of
+				// burning through MessagesRetryCount redelivery attempts on a poison message.
+				permanentErr := false
+				obj, err = decoders.Get(decoderName).Decode(message.Value, message)
+				retries, _ := strconv.Atoi(message.Header(retriesCountHeader))
+				logFields := Fields{Topic: sc.topicId, Partition: message.Partition, Offset: message.Offset, Retries: retries}
 				if err != nil {
-					metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "parse_event_error").Inc()
+					permanentErr = true
+					metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "parse_event_error:"+decoderName).Inc()
 					sc.postEventsLog(message.Value, nil, nil, err)
-					sc.Errorf("Failed to parse event from message: %s offset: %s: %v", message.Value, message.TopicPartition.Offset.String(), err)
+					sc.logger.Errorf(logFields, "Failed to parse event (decoder: %s) from message: %s: %v", decoderName, message.Value, err)
 				} else {
-					sc.Debugf("Consumed Message ID: %s Offset: %s (Retries: %s) for: %s", obj.Id(), message.TopicPartition.Offset.String(), GetKafkaHeader(message, retriesCountHeader), sc.destination.config.BulkerType)
+					sc.logger.Debugf(logFields, "Consumed Message ID: %s for: %s", obj.Id(), sc.destination.config.BulkerType)
 					var state bulker.State
 					var processedObjects []types.Object
 					state, processedObjects, err = (*sc.stream.Load()).Consume(context.Background(), obj)
 					sc.postEventsLog(message.Value, state.Representation, processedObjects, err)
 					if err != nil {
 						metrics.ConsumerErrors(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "bulker_stream_error").Inc()
-						sc.Errorf("Failed to inject event to bulker stream: %v", err)
+						sc.logger.Errorf(logFields, "Failed to inject event to bulker stream: %v", err)
 					} else {
-						metrics.ConsumerMessages(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "processed").Inc()
+						metrics.ConsumerMessages(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "processed:"+decoderName).Inc()
 					}
 				}
 				if err != nil {
 					failedTopic, _ := MakeTopicId(sc.destination.Id(), retryTopicMode, allTablesToken, false)
-					retries, err := GetKafkaIntHeader(message, retriesCountHeader)
-					if err != nil {
-						sc.Errorf("failed to read retry header: %v", err)
+					retries, headerErr := strconv.Atoi(message.Header(retriesCountHeader))
+					if headerErr != nil {
+						sc.logger.Errorf(logFields, "failed to read retry header: %v", headerErr)
 					}
 					status := "retryScheduled"
-					if retries >= sc.config.MessagesRetryCount {
-						//no attempts left - send to dead-letter topic
+					if permanentErr || retries >= sc.config.MessagesRetryCount {
+						//no attempts left, or the error can never succeed on retry - send straight
+						//to dead-letter topic
 						status = "deadLettered"
 						failedTopic, _ = MakeTopicId(sc.destination.Id(), deadTopicMode, allTablesToken, false)
 					}
+					firstFailureTime := message.Header(firstFailureTimeHeader)
+					if firstFailureTime == "" {
+						firstFailureTime = timestamp.ToISOFormat(time.Now().UTC())
+					}
+					headers := []kafka.Header{
+						{Key: retriesCountHeader, Value: []byte(strconv.Itoa(retries))},
+						{Key: originalTopicHeader, Value: []byte(sc.topicId)},
+						{Key: errorMessageHeader, Value: []byte(err.Error())},
+						{Key: firstFailureTimeHeader, Value: []byte(firstFailureTime)},
+						{Key: retryHistoryHeader, Value: []byte(appendRetryHistory(message.Header(retryHistoryHeader), RetryHistoryEntry{Attempt: retries, Time: time.Now().UTC(), Error: err.Error()}))},
+					}
+					if status == "deadLettered" {
+						if permanentErr {
+							headers = append(headers, kafka.Header{Key: permanentErrorHeader, Value: []byte("true")})
+						}
+					} else {
+						delay := RetryBackOffDelay(sc.destination, retries)
+						headers = append(headers, kafka.Header{Key: retryTimeHeader, Value: []byte(timestamp.ToISOFormat(time.Now().UTC().Add(delay)))})
+						headers = append(headers, kafka.Header{Key: retryDelayHeader, Value: []byte(strconv.FormatInt(delay.Milliseconds(), 10))})
+					}
 					retryMessage := kafka.Message{
 						Key:            message.Key,
 						TopicPartition: kafka.TopicPartition{Topic: &failedTopic, Partition: kafka.PartitionAny},
-						Headers: []kafka.Header{
-							{Key: retriesCountHeader, Value: []byte(strconv.Itoa(retries))},
-							{Key: originalTopicHeader, Value: []byte(sc.topicId)},
-							{Key: retryTimeHeader, Value: []byte(timestamp.ToISOFormat(RetryBackOffTime(sc.config, retries+1).UTC()))}},
-						Value: message.Value,
+						Headers:        headers,
+						Value:          message.Value,
 					}
 					err = sc.bulkerProducer.ProduceSync(failedTopic, retryMessage)
 					if err != nil {
-						sc.Errorf("failed to store event to 'failed' topic: %s: %v", failedTopic, err)
+						sc.logger.Errorf(logFields, "failed to store event to 'failed' topic: %s: %v", failedTopic, err)
 						metrics.ConsumerMessages(sc.topicId, "stream", sc.destination.Id(), sc.tableName, "LOST").Inc()
 						continue
 					}
@@ -220,12 +258,22 @@ func (sc *StreamConsumer) start() {
 	})
 }
 
-// Close consumer
-func (sc *StreamConsumer) Close() error {
+// Close stops the consumer loop and waits, up to ctx's deadline, for the current message to be
+// fully committed (or aborted) and the bulker stream to be Complete-d before returning.
+func (sc *StreamConsumer) Close(ctx context.Context) error {
 	sc.Infof("Closing stream consumer. Ver: %s", sc.destination.config.UpdatedAt)
 	close(sc.closed)
+	drained := make(chan struct{})
+	go func() {
+		sc.wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		sc.Errorf("Shutdown deadline exceeded while draining in-flight message. Ver: %s", sc.destination.config.UpdatedAt)
+	}
 	sc.destination.Release()
-	//TODO: wait for closing?
 	return nil
 }
 
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/jitsubase/appbase"
+	"testing"
+	"time"
+)
+
+// TestStreamConsumerRestartConsumer exercises restartConsumer end-to-end against InMemoryClient:
+// the old client must be closed, the replacement built via clientFactory must be subscribed to
+// the same topic, and sc.consumer must be swapped to it once the retry ticker fires.
+func TestStreamConsumerRestartConsumer(t *testing.T) {
+	previous := streamConsumerRestartInterval
+	streamConsumerRestartInterval = 10 * time.Millisecond
+	defer func() { streamConsumerRestartInterval = previous }()
+
+	oldClient := messaging.NewInMemoryClient()
+	newClient := messaging.NewInMemoryClient()
+
+	sc := &StreamConsumer{
+		Service:  appbase.NewServiceBase("test-topic"),
+		topicId:  "test-topic",
+		logger:   NewDestinationLogger("test-destination"),
+		consumer: oldClient,
+		clientFactory: func() (messaging.Client, error) {
+			return newClient, nil
+		},
+		closed: make(chan struct{}),
+	}
+
+	sc.restartConsumer()
+
+	if sc.consumer != newClient {
+		t.Fatalf("restartConsumer did not swap in the client built by clientFactory")
+	}
+	// the previous client is closed from a separate goroutine fired by restartConsumer, so give
+	// it a moment to run rather than asserting on it immediately.
+	deadline := time.Now().Add(time.Second)
+	for !oldClient.Closed() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !oldClient.Closed() {
+		t.Fatalf("restartConsumer did not close the previous client")
+	}
+}
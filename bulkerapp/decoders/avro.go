@@ -0,0 +1,63 @@
+package decoders
+
+import (
+	"fmt"
+	"github.com/hamba/avro/v2"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerlib/types"
+)
+
+// avroDecoder is the package-level instance RegisterSchemaRegistryClient configures and registers.
+// It isn't registered at init() time: unlike json/xml, it can't decode anything until a real
+// SchemaRegistryClient exists, so it isn't exposed as a selectable "decoder" option until then.
+var avroDecoder = NewAvroDecoder()
+
+// SchemaRegistryClient resolves an Avro schema by the wire-format schema id embedded in a
+// Confluent Schema Registry-encoded payload.
+type SchemaRegistryClient interface {
+	SchemaByID(id int) (avro.Schema, error)
+}
+
+// confluentMagicByte is the leading byte of a Confluent Schema Registry-framed payload: magic
+// byte + 4 byte big-endian schema id + Avro binary body.
+const confluentMagicByte = 0x0
+
+// AvroDecoder decodes Confluent Schema Registry-framed Avro payloads.
+type AvroDecoder struct {
+	registry SchemaRegistryClient
+}
+
+// NewAvroDecoder returns an AvroDecoder. It decodes nothing until RegisterSchemaRegistryClient is
+// called, since decoders are registered via init() before the app's Schema Registry client exists.
+func NewAvroDecoder() *AvroDecoder {
+	return &AvroDecoder{}
+}
+
+// RegisterSchemaRegistryClient wires the Schema Registry client into avroDecoder and, only once
+// that's done, registers it under "avro" so DecoderOption can select it. Context.InitContext does
+// not call it, and this package ships no SchemaRegistryClient implementation. Until it is called,
+// decoders.Get("avro") falls back to "json" rather than returning a decoder guaranteed to
+// dead-letter every message it sees.
+func RegisterSchemaRegistryClient(client SchemaRegistryClient) {
+	avroDecoder.registry = client
+	Register("avro", avroDecoder)
+}
+
+func (d *AvroDecoder) Decode(raw []byte, _ *messaging.Message) (types.Object, error) {
+	if d.registry == nil {
+		return nil, fmt.Errorf("avro decoder: no schema registry client configured")
+	}
+	if len(raw) < 5 || raw[0] != confluentMagicByte {
+		return nil, fmt.Errorf("avro decoder: message is not Confluent Schema Registry framed")
+	}
+	schemaId := int(raw[1])<<24 | int(raw[2])<<16 | int(raw[3])<<8 | int(raw[4])
+	schema, err := d.registry.SchemaByID(schemaId)
+	if err != nil {
+		return nil, fmt.Errorf("avro decoder: failed to fetch schema %d: %w", schemaId, err)
+	}
+	obj := types.Object{}
+	if err := avro.Unmarshal(schema, raw[5:], &obj); err != nil {
+		return nil, fmt.Errorf("avro decoder: %w", err)
+	}
+	return obj, nil
+}
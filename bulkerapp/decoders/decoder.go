@@ -0,0 +1,36 @@
+// Package decoders turns raw Kafka message bytes into a types.Object, with the wire format
+// selected per topic or destination instead of being hard-coded to JSON.
+package decoders
+
+import (
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerlib/types"
+)
+
+// Decoder turns a raw message payload into a types.Object. message is passed alongside raw so
+// implementations that need headers or the topic (e.g. a schema id, or a per-destination schema
+// lookup) can use them.
+type Decoder interface {
+	Decode(raw []byte, message *messaging.Message) (types.Object, error)
+}
+
+var registry = make(map[string]Decoder)
+
+// Register adds a Decoder under name (e.g. "json", "protobuf", "avro", "xml"). The json and xml
+// decoders call it from init(); protobuf and avro are registered by RegisterSchemaProvider and
+// RegisterSchemaRegistryClient.
+func Register(name string, decoder Decoder) {
+	registry[name] = decoder
+}
+
+// Get looks up a registered Decoder by name, falling back to "json" - the historical behavior -
+// when name is empty or unknown.
+func Get(name string) Decoder {
+	if name == "" {
+		name = "json"
+	}
+	if d, ok := registry[name]; ok {
+		return d
+	}
+	return registry["json"]
+}
@@ -0,0 +1,27 @@
+package decoders
+
+import (
+	"bytes"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerlib/types"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func init() {
+	Register("json", &JSONDecoder{})
+}
+
+// JSONDecoder decodes a message as a single JSON object. This is the decoder StreamConsumer used
+// unconditionally before the registry existed: numbers are kept as json.Number so downstream type
+// resolution doesn't lose precision.
+type JSONDecoder struct{}
+
+func (d *JSONDecoder) Decode(raw []byte, _ *messaging.Message) (types.Object, error) {
+	obj := types.Object{}
+	dec := jsoniter.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
@@ -0,0 +1,95 @@
+package decoders
+
+import (
+	"fmt"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerlib/types"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"sync"
+)
+
+// protobufDecoder is the package-level instance RegisterSchemaProvider configures and registers.
+// It isn't registered at init() time: unlike json/xml, it can't decode anything until a real
+// SchemaProvider exists, so it isn't exposed as a selectable "decoder" option until then.
+var protobufDecoder = NewProtobufDecoder()
+
+// SchemaProvider resolves the FileDescriptorSet and fully-qualified root message name to use for
+// a given topic. ProtobufDecoder calls it once per topic and caches the result; no destination
+// config option supplies a protobuf schema.
+type SchemaProvider func(topicId string) (set *descriptorpb.FileDescriptorSet, rootMessage string, err error)
+
+// ProtobufDecoder decodes messages whose wire format is a protobuf-encoded message described by
+// a FileDescriptorSet supplied per topic via SchemaProvider. The decoded message is converted to
+// a types.Object through protojson + the JSON decoder, so nested messages/maps/repeated fields
+// land as plain Go values the same way hand-written JSON events do.
+type ProtobufDecoder struct {
+	mu       sync.Mutex
+	schemaOf SchemaProvider
+	cache    map[string]protoreflect.MessageType
+}
+
+// NewProtobufDecoder returns a ProtobufDecoder. It decodes nothing until RegisterSchemaProvider
+// is called, since decoders are registered via init() before destination config is available.
+func NewProtobufDecoder() *ProtobufDecoder {
+	return &ProtobufDecoder{cache: make(map[string]protoreflect.MessageType)}
+}
+
+// RegisterSchemaProvider wires a schema lookup into protobufDecoder and, only once that's done,
+// registers it under "protobuf" so DecoderOption can select it. Context.InitContext does not call
+// it. Until it is called, decoders.Get("protobuf") falls back to "json" rather than
+// returning a decoder guaranteed to dead-letter every message it sees.
+func RegisterSchemaProvider(schemaOf SchemaProvider) {
+	protobufDecoder.schemaOf = schemaOf
+	Register("protobuf", protobufDecoder)
+}
+
+func (d *ProtobufDecoder) Decode(raw []byte, message *messaging.Message) (types.Object, error) {
+	if d.schemaOf == nil {
+		return nil, fmt.Errorf("protobuf decoder: no schema provider configured")
+	}
+	msgType, err := d.messageType(message.Topic)
+	if err != nil {
+		return nil, err
+	}
+	msg := msgType.New().Interface()
+	if err := proto.Unmarshal(raw, msg); err != nil {
+		return nil, fmt.Errorf("protobuf decoder: %w", err)
+	}
+	jsonBytes, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf decoder: failed to convert to json: %w", err)
+	}
+	return Get("json").Decode(jsonBytes, message)
+}
+
+func (d *ProtobufDecoder) messageType(topicId string) (protoreflect.MessageType, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if mt, ok := d.cache[topicId]; ok {
+		return mt, nil
+	}
+	fdSet, rootMessage, err := d.schemaOf(topicId)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf decoder: failed to load schema for %s: %w", topicId, err)
+	}
+	files, err := protodesc.NewFiles(fdSet)
+	if err != nil {
+		return nil, fmt.Errorf("protobuf decoder: invalid schema for %s: %w", topicId, err)
+	}
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(rootMessage))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf decoder: message %s not found: %w", rootMessage, err)
+	}
+	md, ok := descriptor.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("protobuf decoder: %s is not a message", rootMessage)
+	}
+	mt := dynamicpb.NewMessageType(md)
+	d.cache[topicId] = mt
+	return mt, nil
+}
@@ -0,0 +1,91 @@
+package decoders
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/jitsucom/bulker/bulkerapp/messaging"
+	"github.com/jitsucom/bulker/bulkerlib/types"
+	"io"
+	"strings"
+)
+
+func init() {
+	Register("xml", &XMLDecoder{})
+}
+
+// XMLDecoder transforms an XML document into a types.Object the same way the PM XML-to-JSON
+// pipeline does: element names become map keys, repeated sibling elements become an array,
+// attributes are kept as sibling keys prefixed with "@", and a leaf element collapses to its
+// text content.
+type XMLDecoder struct{}
+
+func (d *XMLDecoder) Decode(raw []byte, _ *messaging.Message) (types.Object, error) {
+	dec := xml.NewDecoder(bytes.NewReader(raw))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return types.Object{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		value, err := decodeXMLElement(dec, start)
+		if err != nil {
+			return nil, err
+		}
+		return types.Object{start.Name.Local: value}, nil
+	}
+}
+
+// decodeXMLElement consumes tokens up to and including start's matching EndElement and returns
+// its map/string representation.
+func decodeXMLElement(dec *xml.Decoder, start xml.StartElement) (any, error) {
+	node := map[string]any{}
+	for _, attr := range start.Attr {
+		node["@"+attr.Name.Local] = attr.Value
+	}
+	var text strings.Builder
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			childValue, err := decodeXMLElement(dec, t)
+			if err != nil {
+				return nil, err
+			}
+			addXMLChild(node, t.Name.Local, childValue)
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if len(node) == 0 {
+				return strings.TrimSpace(text.String()), nil
+			}
+			if trimmed := strings.TrimSpace(text.String()); trimmed != "" {
+				node["#text"] = trimmed
+			}
+			return node, nil
+		}
+	}
+}
+
+// addXMLChild adds a decoded child under name, promoting name to an array the second time it's
+// seen so repeated elements aren't silently overwritten.
+func addXMLChild(node map[string]any, name string, value any) {
+	existing, ok := node[name]
+	if !ok {
+		node[name] = value
+		return
+	}
+	if arr, ok := existing.([]any); ok {
+		node[name] = append(arr, value)
+		return
+	}
+	node[name] = []any{existing, value}
+}
@@ -0,0 +1,248 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"sync"
+	"time"
+)
+
+// confluentClient adapts *kafka.Consumer to Client. It is the production backend: everything
+// it does today is exactly what StreamConsumer did inline before this package existed. The
+// producer (from the same configMap the consumer was built with) and the admin client (from the
+// consumer itself) are created lazily, the first time a Produce/CreateTopic/DeleteTopic/ListTopics call needs one - most Client
+// users (e.g. StreamConsumer) only ever read, so paying for a producer/admin connection upfront
+// would be wasted on them.
+type confluentClient struct {
+	consumer     *kafka.Consumer
+	cb           RebalanceCallback
+	configMap    kafka.ConfigMap
+	producerOnce sync.Once
+	producer     *kafka.Producer
+	producerErr  error
+	adminOnce    sync.Once
+	admin        *kafka.AdminClient
+	adminErr     error
+}
+
+// NewConsumer creates a *kafka.Consumer from configMap and wraps it as a Client. configMap is the same
+// kafka.ConfigMap callers built before; this package doesn't change how brokers are configured,
+// only how the rest of the app talks to the resulting client.
+func NewConsumer(configMap *kafka.ConfigMap) (Client, error) {
+	consumer, err := kafka.NewConsumer(configMap)
+	if err != nil {
+		return nil, err
+	}
+	return &confluentClient{consumer: consumer, configMap: kafka.ConfigMap(*configMap)}, nil
+}
+
+func (c *confluentClient) getProducer() (*kafka.Producer, error) {
+	c.producerOnce.Do(func() {
+		producerConfig := c.configMap
+		c.producer, c.producerErr = kafka.NewProducer(&producerConfig)
+	})
+	return c.producer, c.producerErr
+}
+
+func (c *confluentClient) getAdmin() (*kafka.AdminClient, error) {
+	c.adminOnce.Do(func() {
+		c.admin, c.adminErr = kafka.NewAdminClientFromConsumer(c.consumer)
+	})
+	return c.admin, c.adminErr
+}
+
+func (c *confluentClient) SubscribeTopics(topics []string, cb RebalanceCallback) error {
+	c.cb = cb
+	if cb == nil {
+		return c.consumer.SubscribeTopics(topics, nil)
+	}
+	return c.consumer.SubscribeTopics(topics, func(_ *kafka.Consumer, event kafka.Event) error {
+		switch e := event.(type) {
+		case kafka.AssignedPartitions:
+			return cb(true, toTopicPartitions(e.Partitions))
+		case kafka.RevokedPartitions:
+			return cb(false, toTopicPartitions(e.Partitions))
+		default:
+			return nil
+		}
+	})
+}
+
+func (c *confluentClient) ReadMessage(timeout time.Duration) (*Message, error) {
+	msg, err := c.consumer.ReadMessage(timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		Topic:     *msg.TopicPartition.Topic,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    int64(msg.TopicPartition.Offset),
+		Key:       msg.Key,
+		Value:     msg.Value,
+		Headers:   toHeaders(msg.Headers),
+		Timestamp: msg.Timestamp,
+	}, nil
+}
+
+// Commit commits the consumer's current offsets for every assigned partition.
+// AbstractBatchConsumer's batch loops do not use it; they commit per partition via
+// BatchClient.CommitOffsets or TransactionalProducer.SendOffsetsToTransaction.
+func (c *confluentClient) Commit() error {
+	_, err := c.consumer.Commit()
+	return err
+}
+
+func (c *confluentClient) Close() error {
+	if c.producer != nil {
+		c.producer.Close()
+	}
+	if c.admin != nil {
+		c.admin.Close()
+	}
+	return c.consumer.Close()
+}
+
+// Produce sends msg fire-and-forget: like the partition producers in AbstractBatchConsumer, it
+// doesn't wait for the delivery report on producer.Events() - callers that need delivery
+// confirmation should drain that channel themselves via the underlying broker client.
+func (c *confluentClient) Produce(msg *Message) error {
+	producer, err := c.getProducer()
+	if err != nil {
+		return err
+	}
+	topic := msg.Topic
+	return producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: msg.Partition, Offset: kafka.Offset(msg.Offset)},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        fromHeaders(msg.Headers),
+	}, nil)
+}
+
+func (c *confluentClient) Flush(timeout time.Duration) int {
+	producer, err := c.getProducer()
+	if err != nil {
+		return 0
+	}
+	return producer.Flush(int(timeout.Milliseconds()))
+}
+
+func (c *confluentClient) CreateTopic(topic string, numPartitions int) error {
+	admin, err := c.getAdmin()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := admin.CreateTopics(ctx, []kafka.TopicSpecification{{Topic: topic, NumPartitions: numPartitions, ReplicationFactor: 1}})
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error.Code() != kafka.ErrNoError && r.Error.Code() != kafka.ErrTopicAlreadyExists {
+			return r.Error
+		}
+	}
+	return nil
+}
+
+func (c *confluentClient) DeleteTopic(topic string) error {
+	admin, err := c.getAdmin()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	results, err := admin.DeleteTopics(ctx, []string{topic})
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.Error.Code() != kafka.ErrNoError {
+			return r.Error
+		}
+	}
+	return nil
+}
+
+func (c *confluentClient) ListTopics() ([]string, error) {
+	admin, err := c.getAdmin()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := admin.GetMetadata(nil, true, 10000)
+	if err != nil {
+		return nil, err
+	}
+	topics := make([]string, 0, len(metadata.Topics))
+	for topic := range metadata.Topics {
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+func (c *confluentClient) PartitionCount(topic string) (int, error) {
+	admin, err := c.getAdmin()
+	if err != nil {
+		return 0, err
+	}
+	metadata, err := admin.GetMetadata(&topic, false, 10000)
+	if err != nil {
+		return 0, err
+	}
+	topicMetadata, ok := metadata.Topics[topic]
+	if !ok {
+		return 0, fmt.Errorf("messaging: no metadata returned for topic %s", topic)
+	}
+	if topicMetadata.Error.Code() != kafka.ErrNoError {
+		return 0, topicMetadata.Error
+	}
+	return len(topicMetadata.Partitions), nil
+}
+
+func (c *confluentClient) IsTimeout(err error) bool {
+	kafkaErr, ok := err.(kafka.Error)
+	return ok && kafkaErr.Code() == kafka.ErrTimedOut
+}
+
+func (c *confluentClient) IsRetriable(err error) bool {
+	kafkaErr, ok := err.(kafka.Error)
+	return ok && kafkaErr.IsRetriable()
+}
+
+func (c *confluentClient) Code(err error) string {
+	kafkaErr, ok := err.(kafka.Error)
+	if !ok {
+		return "UNKNOWN"
+	}
+	return kafkaErr.Code().String()
+}
+
+func toHeaders(headers []kafka.Header) []Header {
+	res := make([]Header, len(headers))
+	for i, h := range headers {
+		res[i] = Header{Key: h.Key, Value: h.Value}
+	}
+	return res
+}
+
+func fromHeaders(headers []Header) []kafka.Header {
+	res := make([]kafka.Header, len(headers))
+	for i, h := range headers {
+		res[i] = kafka.Header{Key: h.Key, Value: h.Value}
+	}
+	return res
+}
+
+func toTopicPartitions(partitions []kafka.TopicPartition) []TopicPartition {
+	res := make([]TopicPartition, len(partitions))
+	for i, p := range partitions {
+		topic := ""
+		if p.Topic != nil {
+			topic = *p.Topic
+		}
+		res[i] = TopicPartition{Topic: topic, Partition: p.Partition, Offset: int64(p.Offset)}
+	}
+	return res
+}
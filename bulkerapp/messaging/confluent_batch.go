@@ -0,0 +1,194 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"time"
+)
+
+// NewBatchClient creates a *kafka.Consumer from configMap and wraps it as a BatchClient, the same
+// way NewConsumer does for a plain Client. configMap is kept around (rather than just the
+// consumer) so NewPartitionProducer can build each partition's dedicated producer from it.
+func NewBatchClient(configMap *kafka.ConfigMap) (BatchClient, error) {
+	consumer, err := kafka.NewConsumer(configMap)
+	if err != nil {
+		return nil, err
+	}
+	return &confluentClient{consumer: consumer, configMap: kafka.ConfigMap(*configMap)}, nil
+}
+
+func (c *confluentClient) QueryWatermarkOffsets(topic string, partition int32, timeout time.Duration) (int64, int64, error) {
+	return c.consumer.QueryWatermarkOffsets(topic, partition, int(timeout.Milliseconds()))
+}
+
+func (c *confluentClient) SeekPartitions(partitions []TopicPartition) error {
+	_, err := c.consumer.SeekPartitions(fromTopicPartitions(partitions))
+	return err
+}
+
+func (c *confluentClient) CommitOffsets(offsets []TopicPartition) error {
+	_, err := c.consumer.CommitOffsets(fromTopicPartitions(offsets))
+	return err
+}
+
+func (c *confluentClient) Committed(partitions []TopicPartition, timeout time.Duration) ([]TopicPartition, error) {
+	committed, err := c.consumer.Committed(fromTopicPartitions(partitions), int(timeout.Milliseconds()))
+	if err != nil {
+		return nil, err
+	}
+	return toTopicPartitions(committed), nil
+}
+
+func (c *confluentClient) Assignment() ([]TopicPartition, error) {
+	assignment, err := c.consumer.Assignment()
+	if err != nil {
+		return nil, err
+	}
+	return toTopicPartitions(assignment), nil
+}
+
+func (c *confluentClient) Pause(partitions []TopicPartition) error {
+	return c.consumer.Pause(fromTopicPartitions(partitions))
+}
+
+func (c *confluentClient) Resume(partitions []TopicPartition) error {
+	return c.consumer.Resume(fromTopicPartitions(partitions))
+}
+
+func (c *confluentClient) GroupMetadata() (GroupMetadata, error) {
+	metadata, err := c.consumer.GetConsumerGroupMetadata()
+	if err != nil {
+		return GroupMetadata{}, err
+	}
+	return GroupMetadata{raw: metadata}, nil
+}
+
+// NewPartitionProducer builds a dedicated *kafka.Producer for one partition worker, configured
+// with configOverrides (typically just transactional.id) layered on top of the broker config this
+// Client was built from. When transactional is false, transactional.id is never set and
+// InitTransactions is never called, since a transactional producer rejects Produce calls made
+// outside an open transaction - that's exactly how RetryConsumer's non-transactional mode uses it.
+func (c *confluentClient) NewPartitionProducer(configOverrides map[string]string, transactional bool) (TransactionalProducer, error) {
+	producerConfig := kafka.ConfigMap{}
+	for k, v := range c.configMap {
+		_ = producerConfig.SetKey(k, v)
+	}
+	for k, v := range configOverrides {
+		_ = producerConfig.SetKey(k, v)
+	}
+	producer, err := kafka.NewProducer(&producerConfig)
+	if err != nil {
+		return nil, err
+	}
+	if transactional {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err = producer.InitTransactions(ctx); err != nil {
+			producer.Close()
+			return nil, err
+		}
+	}
+	return &confluentTransactionalProducer{producer: producer}, nil
+}
+
+// confluentTransactionalProducer adapts *kafka.Producer to TransactionalProducer.
+type confluentTransactionalProducer struct {
+	producer *kafka.Producer
+}
+
+func (p *confluentTransactionalProducer) Produce(msg *Message) error {
+	topic := msg.Topic
+	return p.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        fromHeaders(msg.Headers),
+	}, nil)
+}
+
+func (p *confluentTransactionalProducer) Flush(timeout time.Duration) int {
+	return p.producer.Flush(int(timeout.Milliseconds()))
+}
+
+func (p *confluentTransactionalProducer) ProduceSync(msg *Message) error {
+	topic := msg.Topic
+	deliveryChan := make(chan kafka.Event, 1)
+	err := p.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Key:            msg.Key,
+		Value:          msg.Value,
+		Headers:        fromHeaders(msg.Headers),
+	}, deliveryChan)
+	if err != nil {
+		return err
+	}
+	delivered := (<-deliveryChan).(*kafka.Message)
+	if delivered.TopicPartition.Error != nil {
+		return delivered.TopicPartition.Error
+	}
+	return nil
+}
+
+func (p *confluentTransactionalProducer) Events() <-chan DeliveryReport {
+	out := make(chan DeliveryReport)
+	go func() {
+		defer close(out)
+		for e := range p.producer.Events() {
+			msg, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			report := DeliveryReport{Message: &Message{
+				Topic:     *msg.TopicPartition.Topic,
+				Partition: msg.TopicPartition.Partition,
+				Offset:    int64(msg.TopicPartition.Offset),
+				Key:       msg.Key,
+				Value:     msg.Value,
+				Headers:   toHeaders(msg.Headers),
+			}}
+			if msg.TopicPartition.Error != nil {
+				report.Err = msg.TopicPartition.Error
+			}
+			out <- report
+		}
+	}()
+	return out
+}
+
+func (p *confluentTransactionalProducer) InitTransactions(ctx context.Context) error {
+	return p.producer.InitTransactions(ctx)
+}
+
+func (p *confluentTransactionalProducer) BeginTransaction() error {
+	return p.producer.BeginTransaction()
+}
+
+func (p *confluentTransactionalProducer) CommitTransaction(ctx context.Context) error {
+	return p.producer.CommitTransaction(ctx)
+}
+
+func (p *confluentTransactionalProducer) AbortTransaction(ctx context.Context) error {
+	return p.producer.AbortTransaction(ctx)
+}
+
+func (p *confluentTransactionalProducer) SendOffsetsToTransaction(ctx context.Context, offsets []TopicPartition, group GroupMetadata) error {
+	groupMetadata, ok := group.raw.(*kafka.ConsumerGroupMetadata)
+	if !ok {
+		return fmt.Errorf("messaging: GroupMetadata was not produced by this BatchClient implementation")
+	}
+	return p.producer.SendOffsetsToTransaction(ctx, fromTopicPartitions(offsets), groupMetadata)
+}
+
+func (p *confluentTransactionalProducer) Close() {
+	p.producer.Close()
+}
+
+func fromTopicPartitions(partitions []TopicPartition) []kafka.TopicPartition {
+	res := make([]kafka.TopicPartition, len(partitions))
+	for i, p := range partitions {
+		topic := p.Topic
+		res[i] = kafka.TopicPartition{Topic: &topic, Partition: p.Partition, Offset: kafka.Offset(p.Offset)}
+	}
+	return res
+}
@@ -0,0 +1,176 @@
+package messaging
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrNoMessages is returned by InMemoryClient.ReadMessage when no message is available within
+// the requested timeout, mirroring a broker read timeout.
+var ErrNoMessages = errors.New("messaging: no message within timeout")
+
+// InMemoryClient is a Client backed by a plain in-process queue. It exists so unit tests can
+// drive StreamConsumer/restartConsumer/retry paths without a real Kafka broker.
+type InMemoryClient struct {
+	mu         sync.Mutex
+	queue      []*Message
+	closed     bool
+	topics     []string
+	ioErr      error // next ReadMessage call returns this error instead of reading
+	retriable  bool
+	produced   []*Message
+	commits    int
+	topicsById map[string]int // created topics by name -> partition count
+}
+
+// NewInMemoryClient returns an empty InMemoryClient ready to be Push-ed to in a test.
+func NewInMemoryClient() *InMemoryClient {
+	return &InMemoryClient{topicsById: make(map[string]int)}
+}
+
+// Push enqueues a message as if it had been produced to the subscribed topic.
+func (c *InMemoryClient) Push(msg *Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queue = append(c.queue, msg)
+}
+
+// FailNextRead makes the next ReadMessage call return err instead of draining the queue, so
+// tests can exercise StreamConsumer's retry/restart branches deterministically.
+func (c *InMemoryClient) FailNextRead(err error, retriable bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ioErr = err
+	c.retriable = retriable
+}
+
+func (c *InMemoryClient) SubscribeTopics(topics []string, _ RebalanceCallback) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topics = topics
+	return nil
+}
+
+func (c *InMemoryClient) ReadMessage(timeout time.Duration) (*Message, error) {
+	c.mu.Lock()
+	if c.ioErr != nil {
+		err := c.ioErr
+		c.ioErr = nil
+		c.mu.Unlock()
+		return nil, err
+	}
+	if len(c.queue) > 0 {
+		msg := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+		return msg, nil
+	}
+	c.mu.Unlock()
+	time.Sleep(timeout)
+	return nil, ErrNoMessages
+}
+
+// Commit records that a commit happened; tests assert on Commits() rather than tracking real
+// offsets, since InMemoryClient's queue has no notion of a committed position.
+func (c *InMemoryClient) Commit() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.commits++
+	return nil
+}
+
+// Commits returns how many times Commit has been called, for tests to assert against.
+func (c *InMemoryClient) Commits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commits
+}
+
+// Produce records msg instead of sending it anywhere; tests inspect it via Produced.
+func (c *InMemoryClient) Produce(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.produced = append(c.produced, msg)
+	return nil
+}
+
+// Produced returns every message handed to Produce so far, in order.
+func (c *InMemoryClient) Produced() []*Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*Message(nil), c.produced...)
+}
+
+func (c *InMemoryClient) Flush(_ time.Duration) int {
+	return 0
+}
+
+func (c *InMemoryClient) CreateTopic(topic string, numPartitions int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.topicsById[topic] = numPartitions
+	return nil
+}
+
+func (c *InMemoryClient) DeleteTopic(topic string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.topicsById, topic)
+	return nil
+}
+
+func (c *InMemoryClient) ListTopics() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.topicsById))
+	for topic := range c.topicsById {
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
+
+// PartitionCount returns the partition count topic was created with via CreateTopic, or an error
+// if it isn't known to this client - tests that need validateCopartitioning to see a given
+// partition count should call CreateTopic first.
+func (c *InMemoryClient) PartitionCount(topic string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	count, ok := c.topicsById[topic]
+	if !ok {
+		return 0, fmt.Errorf("messaging: unknown topic %s", topic)
+	}
+	return count, nil
+}
+
+func (c *InMemoryClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Closed reports whether Close has been called, for tests to assert against.
+func (c *InMemoryClient) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *InMemoryClient) IsTimeout(err error) bool {
+	return errors.Is(err, ErrNoMessages)
+}
+
+func (c *InMemoryClient) IsRetriable(err error) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.retriable
+}
+
+func (c *InMemoryClient) Code(err error) string {
+	if errors.Is(err, ErrNoMessages) {
+		return "_TIMED_OUT"
+	}
+	return "TEST_ERROR"
+}
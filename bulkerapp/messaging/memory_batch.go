@@ -0,0 +1,274 @@
+package messaging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// InMemoryBatchClient is a BatchClient backed by InMemoryClient, extended with the bookkeeping
+// AbstractBatchConsumer's batch loop and lag sampler need - watermarks, committed offsets,
+// assignment and pause/resume tracking - plus the ability to mint InMemoryTransactionalProducer
+// fakes, so tests can drive processBatchTransactional/processBatchNonTransactional without a live
+// broker the same way InMemoryClient already lets StreamConsumer tests do.
+type InMemoryBatchClient struct {
+	*InMemoryClient
+
+	mu         sync.Mutex
+	watermarks map[int32]int64
+	committed  map[int32]int64
+	assignment []TopicPartition
+	paused     map[int32]bool
+	producers  []*InMemoryTransactionalProducer
+}
+
+// NewInMemoryBatchClient returns an empty InMemoryBatchClient ready to be Push-ed to in a test.
+func NewInMemoryBatchClient() *InMemoryBatchClient {
+	return &InMemoryBatchClient{
+		InMemoryClient: NewInMemoryClient(),
+		watermarks:     make(map[int32]int64),
+		committed:      make(map[int32]int64),
+		paused:         make(map[int32]bool),
+	}
+}
+
+// SetWatermark fixes the high watermark offset reported for partition by QueryWatermarkOffsets,
+// used by tests to control when processBatchTransactional/processBatchNonTransactional decide
+// they've reached the end of a partition.
+func (c *InMemoryBatchClient) SetWatermark(partition int32, high int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watermarks[partition] = high
+}
+
+func (c *InMemoryBatchClient) QueryWatermarkOffsets(_ string, partition int32, _ time.Duration) (int64, int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return 0, c.watermarks[partition], nil
+}
+
+func (c *InMemoryBatchClient) SeekPartitions(_ []TopicPartition) error {
+	return nil
+}
+
+func (c *InMemoryBatchClient) CommitOffsets(offsets []TopicPartition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, o := range offsets {
+		c.committed[o.Partition] = o.Offset
+	}
+	return nil
+}
+
+// CommittedOffset returns the last offset committed for partition via CommitOffsets, for tests to
+// assert against - ok is false if nothing has been committed yet.
+func (c *InMemoryBatchClient) CommittedOffset(partition int32) (offset int64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offset, ok = c.committed[partition]
+	return
+}
+
+func (c *InMemoryBatchClient) Committed(partitions []TopicPartition, _ time.Duration) ([]TopicPartition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	res := make([]TopicPartition, len(partitions))
+	for i, p := range partitions {
+		offset, ok := c.committed[p.Partition]
+		if !ok {
+			offset = -1
+		}
+		res[i] = TopicPartition{Topic: p.Topic, Partition: p.Partition, Offset: offset}
+	}
+	return res, nil
+}
+
+func (c *InMemoryBatchClient) Assignment() ([]TopicPartition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]TopicPartition(nil), c.assignment...), nil
+}
+
+// SetAssignment fixes what Assignment reports, used by tests exercising pause/resume.
+func (c *InMemoryBatchClient) SetAssignment(partitions []TopicPartition) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.assignment = partitions
+}
+
+func (c *InMemoryBatchClient) Pause(partitions []TopicPartition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range partitions {
+		c.paused[p.Partition] = true
+	}
+	return nil
+}
+
+func (c *InMemoryBatchClient) Resume(partitions []TopicPartition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range partitions {
+		c.paused[p.Partition] = false
+	}
+	return nil
+}
+
+func (c *InMemoryBatchClient) GroupMetadata() (GroupMetadata, error) {
+	return GroupMetadata{raw: "test-group-metadata"}, nil
+}
+
+// NewPartitionProducer mints an InMemoryTransactionalProducer, recorded on Producers() so a test
+// can configure a failure on it or inspect what it produced after the fact.
+func (c *InMemoryBatchClient) NewPartitionProducer(_ map[string]string, transactional bool) (TransactionalProducer, error) {
+	producer := NewInMemoryTransactionalProducer(transactional)
+	c.mu.Lock()
+	c.producers = append(c.producers, producer)
+	c.mu.Unlock()
+	return producer, nil
+}
+
+// Producers returns every InMemoryTransactionalProducer minted via NewPartitionProducer so far.
+func (c *InMemoryBatchClient) Producers() []*InMemoryTransactionalProducer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*InMemoryTransactionalProducer(nil), c.producers...)
+}
+
+// InMemoryTransactionalProducer is a TransactionalProducer backed by an in-process log of produced
+// messages, with an optional injected failure for one specific message (matched by key) so tests
+// can exercise partial-batch-failure handling without a live broker.
+type InMemoryTransactionalProducer struct {
+	transactional bool
+
+	mu          sync.Mutex
+	produced    []*Message
+	events      chan DeliveryReport
+	closed      bool
+	failKey     string
+	failErr     error
+	begins      int
+	commits     int
+	aborts      int
+	offsetsSent []TopicPartition
+}
+
+func NewInMemoryTransactionalProducer(transactional bool) *InMemoryTransactionalProducer {
+	return &InMemoryTransactionalProducer{transactional: transactional, events: make(chan DeliveryReport, 16)}
+}
+
+// FailProduceForKey makes every ProduceSync call for a message with this key return err, and every
+// Produce call for it report err on Events (returning nil) without recording the message, so a
+// test can exercise a single message failing mid-batch.
+func (p *InMemoryTransactionalProducer) FailProduceForKey(key string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failKey = key
+	p.failErr = err
+}
+
+func (p *InMemoryTransactionalProducer) shouldFail(msg *Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.failKey != "" && string(msg.Key) == p.failKey {
+		return p.failErr
+	}
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) Produce(msg *Message) error {
+	if err := p.shouldFail(msg); err != nil {
+		p.events <- DeliveryReport{Message: msg, Err: err}
+		return nil
+	}
+	p.mu.Lock()
+	p.produced = append(p.produced, msg)
+	p.mu.Unlock()
+	p.events <- DeliveryReport{Message: msg}
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) ProduceSync(msg *Message) error {
+	if err := p.shouldFail(msg); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.produced = append(p.produced, msg)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) Flush(_ time.Duration) int {
+	return 0
+}
+
+func (p *InMemoryTransactionalProducer) Events() <-chan DeliveryReport {
+	return p.events
+}
+
+// Produced returns every message that was successfully produced so far, in order.
+func (p *InMemoryTransactionalProducer) Produced() []*Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*Message(nil), p.produced...)
+}
+
+func (p *InMemoryTransactionalProducer) InitTransactions(_ context.Context) error {
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) BeginTransaction() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.transactional {
+		return fmt.Errorf("messaging: BeginTransaction called on a non-transactional producer")
+	}
+	p.begins++
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) CommitTransaction(_ context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commits++
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) AbortTransaction(_ context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.aborts++
+	p.produced = nil
+	return nil
+}
+
+func (p *InMemoryTransactionalProducer) SendOffsetsToTransaction(_ context.Context, offsets []TopicPartition, _ GroupMetadata) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.offsetsSent = append(p.offsetsSent, offsets...)
+	return nil
+}
+
+// Commits returns how many times CommitTransaction has been called, for tests to assert against.
+func (p *InMemoryTransactionalProducer) Commits() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.commits
+}
+
+// Aborts returns how many times AbortTransaction has been called, for tests to assert against.
+func (p *InMemoryTransactionalProducer) Aborts() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.aborts
+}
+
+func (p *InMemoryTransactionalProducer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+	}
+}
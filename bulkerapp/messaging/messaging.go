@@ -0,0 +1,182 @@
+// Package messaging abstracts the Kafka client used by the consumers and producers in the
+// bulkerapp/app package behind a small interface, so that the app can (a) be driven by brokers
+// other than confluent-kafka-go/librdkafka and (b) be unit tested without a live broker.
+//
+// StreamConsumer depends on Client; AbstractBatchConsumer depends on the richer BatchClient below,
+// since its batch loop also needs watermark/assignment/pause-resume, transactional commits, and a
+// dedicated TransactionalProducer per partition (via BatchClient.NewPartitionProducer). Producer
+// and TopicManager still call the confluent-kafka-go package directly and remain candidates for a
+// follow-up conversion.
+package messaging
+
+import (
+	"context"
+	"time"
+)
+
+// Message is a broker-agnostic view of a record read from or produced to a topic. Timestamp is
+// only meaningful on messages returned by Consumer.ReadMessage (the broker's record timestamp);
+// it's zero on a message a caller is about to produce.
+type Message struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   []Header
+	Timestamp time.Time
+}
+
+// Header returns the value of the first header matching key, or "" if absent.
+func (m *Message) Header(key string) string {
+	for _, h := range m.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// TopicPartition identifies a partition and, where relevant, an offset within it.
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// Header is a single Kafka-style message header (repeatable, ordered key/value pair).
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// RebalanceCallback is invoked by Client on partition assignment/revocation during a consumer
+// group rebalance. assigned is true for an AssignedPartitions event, false for Revoked.
+type RebalanceCallback func(assigned bool, partitions []TopicPartition) error
+
+// Consumer is the subset of consumer behavior StreamConsumer (and, eventually, BatchConsumer)
+// need from a broker client.
+type Consumer interface {
+	SubscribeTopics(topics []string, cb RebalanceCallback) error
+	ReadMessage(timeout time.Duration) (*Message, error)
+	Commit() error
+	Close() error
+}
+
+// Producer is the subset of producer behavior a broker client needs to expose so produce paths
+// (StreamConsumer's failed-topic routing, AbstractBatchConsumer's retry/DLQ producers) can be
+// written against Client instead of *kafka.Producer directly.
+type Producer interface {
+	Produce(msg *Message) error
+	Flush(timeout time.Duration) int
+}
+
+// Admin is the topic-management subset a broker client needs to expose, so TopicManager can be
+// written against Client instead of calling kafka.AdminClient/kafka.Producer directly.
+type Admin interface {
+	CreateTopic(topic string, numPartitions int) error
+	DeleteTopic(topic string) error
+	ListTopics() ([]string, error)
+	// PartitionCount returns topic's partition count, used by AbstractBatchConsumer's
+	// validateCopartitioning to check that every topic in a "copartitioned" group actually has a
+	// matching partition count.
+	PartitionCount(topic string) (int, error)
+}
+
+// ErrorClassifier lets callers branch on broker error semantics without importing a
+// broker-specific error type.
+type ErrorClassifier interface {
+	IsTimeout(err error) bool
+	IsRetriable(err error) bool
+	Code(err error) string
+}
+
+// Client is the full surface a broker client needs to expose to back every consumer/producer/
+// admin use in bulkerapp/app - StreamConsumer depends on this; AbstractBatchConsumer depends on
+// the richer BatchClient below. Implementations: confluent-kafka-go backed (production) and an
+// in-memory one (tests).
+type Client interface {
+	Consumer
+	Producer
+	Admin
+	ErrorClassifier
+}
+
+// Factory creates a fresh, already-subscribed-on-demand Client. StreamConsumer.restartConsumer
+// calls this to rebuild its client after an unrecoverable read error, the same way it used to
+// call kafka.NewConsumer directly.
+type Factory func() (Client, error)
+
+// GroupMetadata opaquely carries a consumer group's metadata snapshot from
+// BatchClient.GroupMetadata through to TransactionalProducer.SendOffsetsToTransaction, so a
+// partition's consumer offset can be advanced atomically with its producer transaction. Its
+// contents are broker-specific; callers only ever pass it straight through, never inspect it.
+type GroupMetadata struct {
+	raw any
+}
+
+// DeliveryReport describes the broker's outcome for a message produced via Producer.Produce,
+// delivered asynchronously on TransactionalProducer.Events so a caller that doesn't need
+// synchronous confirmation (see ProduceSync) can still log a failed delivery.
+type DeliveryReport struct {
+	Message *Message
+	Err     error
+}
+
+// BatchClient extends Client with the partition-level operations AbstractBatchConsumer's batch
+// loop and lag sampler need - watermark queries, explicit offset control, pause/resume and
+// consumer-group metadata - plus the ability to mint a dedicated per-partition
+// TransactionalProducer, so AbstractBatchConsumer can depend on messaging.Client the same way
+// StreamConsumer does instead of calling confluent-kafka-go directly.
+type BatchClient interface {
+	Client
+	// QueryWatermarkOffsets returns the low/high watermark offsets of partition on topic.
+	QueryWatermarkOffsets(topic string, partition int32, timeout time.Duration) (low, high int64, err error)
+	// SeekPartitions rewinds the consumer's position on each given partition, used to roll back to
+	// the start of a failed batch so none of it is lost.
+	SeekPartitions(partitions []TopicPartition) error
+	// CommitOffsets commits exactly the given partitions' offsets, rather than every assigned
+	// partition the way Consumer.Commit does - AbstractBatchConsumer's per-partition batches must
+	// never advance another partition's offset out from under its own worker.
+	CommitOffsets(offsets []TopicPartition) error
+	// Committed returns the last committed offset of each given partition.
+	Committed(partitions []TopicPartition, timeout time.Duration) ([]TopicPartition, error)
+	// Assignment returns the partitions currently assigned to this consumer.
+	Assignment() ([]TopicPartition, error)
+	// Pause/Resume pause and resume delivery on the given partitions without leaving the consumer
+	// group, used while a batch is paused between cycles or a destination is being drained.
+	Pause(partitions []TopicPartition) error
+	Resume(partitions []TopicPartition) error
+	// GroupMetadata snapshots this consumer's group membership, for
+	// TransactionalProducer.SendOffsetsToTransaction.
+	GroupMetadata() (GroupMetadata, error)
+	// NewPartitionProducer mints a dedicated TransactionalProducer for one partition worker,
+	// configured with configOverrides (e.g. a distinct transactional.id) layered onto the same
+	// broker config this Client was built from. transactional selects whether InitTransactions is
+	// called; a transactional producer rejects Produce calls made outside an open transaction,
+	// which is why RetryConsumer's non-transactional mode passes false (see NewRetryConsumer).
+	NewPartitionProducer(configOverrides map[string]string, transactional bool) (TransactionalProducer, error)
+}
+
+// TransactionalProducer is a Producer that additionally supports the explicit transaction
+// lifecycle AbstractBatchConsumer's transactional batch commits need: begin/commit/abort plus
+// atomically advancing a consumer offset alongside the transaction via SendOffsetsToTransaction.
+// Produced messages that aren't confirmed synchronously via ProduceSync report their delivery
+// outcome on Events instead.
+type TransactionalProducer interface {
+	Producer
+	InitTransactions(ctx context.Context) error
+	BeginTransaction() error
+	CommitTransaction(ctx context.Context) error
+	AbortTransaction(ctx context.Context) error
+	SendOffsetsToTransaction(ctx context.Context, offsets []TopicPartition, group GroupMetadata) error
+	// ProduceSync produces msg and blocks for its delivery report, returning the delivery error (or
+	// nil) directly instead of routing it to Events - used where the caller must know
+	// synchronously whether each message landed, e.g. RetryConsumer's non-transactional mode, which
+	// only commits a message's consumer offset once its delivery is confirmed.
+	ProduceSync(msg *Message) error
+	// Events is where delivery reports for messages produced via Produce (not ProduceSync) arrive,
+	// so a long-lived event-logging loop can report failures without blocking the produce call.
+	Events() <-chan DeliveryReport
+	Close()
+}
@@ -86,6 +86,81 @@ var (
 		ParseFunc: utils.ParseString,
 	}
 
+	// RetryPolicyOption controls backoff redelivery of failed stream/retry-topic messages. Unset
+	// fields fall back to DefaultRetryPolicy's values.
+	RetryPolicyOption = ImplementationOption[RetryPolicy]{
+		Key:          "retryPolicy",
+		DefaultValue: DefaultRetryPolicy,
+		AdvancedParseFunc: func(o *ImplementationOption[RetryPolicy], serialized any) (StreamOption, error) {
+			m, ok := serialized.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("failed to parse 'retryPolicy' option: %v incorrect type: %T expected map", serialized, serialized)
+			}
+			policy := DefaultRetryPolicy
+			if v, ok := m["retryStrategy"]; ok {
+				sv, err := utils.ParseString(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.retryStrategy' option: %v", err)
+				}
+				policy.Strategy = sv
+			}
+			if v, ok := m["retryBaseDelaySec"]; ok {
+				iv, err := utils.ParseInt(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.retryBaseDelaySec' option: %v", err)
+				}
+				policy.BaseDelaySec = iv
+			}
+			if v, ok := m["retryMaxDelaySec"]; ok {
+				iv, err := utils.ParseInt(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.retryMaxDelaySec' option: %v", err)
+				}
+				policy.MaxDelaySec = iv
+			}
+			if v, ok := m["retryFactor"]; ok {
+				fv, err := utils.ParseFloat(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.retryFactor' option: %v", err)
+				}
+				policy.Factor = fv
+			}
+			if v, ok := m["retryStepSec"]; ok {
+				iv, err := utils.ParseInt(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.retryStepSec' option: %v", err)
+				}
+				policy.StepSec = iv
+			}
+			if v, ok := m["retryJitterPct"]; ok {
+				fv, err := utils.ParseFloat(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.retryJitterPct' option: %v", err)
+				}
+				policy.JitterPct = fv
+			}
+			if v, ok := m["nackRedeliveryDelaySec"]; ok {
+				iv, err := utils.ParseInt(v)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse 'retryPolicy.nackRedeliveryDelaySec' option: %v", err)
+				}
+				policy.NackRedeliveryDelaySec = iv
+			}
+			return func(options *StreamOptions) {
+				o.Set(options, policy)
+			}, nil
+		},
+	}
+
+	// DecoderOption selects which decoders.Decoder (by registry name, e.g. "json", "protobuf",
+	// "avro", "xml") is used to parse raw Kafka message bytes into a types.Object. Empty means
+	// "json", the historical hard-coded behavior.
+	DecoderOption = ImplementationOption[string]{
+		Key:          "decoder",
+		DefaultValue: "json",
+		ParseFunc:    utils.ParseString,
+	}
+
 	// Not used by bulker. Just added here to be treated as known options
 	FunctionsOption  = ImplementationOption[any]{Key: "functions", ParseFunc: func(serialized any) (any, error) { return nil, nil }}
 	StreamsOption    = ImplementationOption[any]{Key: "streams", ParseFunc: func(serialized any) (any, error) { return nil, nil }}
@@ -104,6 +179,8 @@ func init() {
 	RegisterOption(&MergeRowsOption)
 	RegisterOption(&PartitionIdOption)
 	RegisterOption(&TimestampOption)
+	RegisterOption(&DecoderOption)
+	RegisterOption(&RetryPolicyOption)
 
 	// Not used by bulker. Just added here to be treated as known options
 	RegisterOption(&FunctionsOption)
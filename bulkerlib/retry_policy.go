@@ -0,0 +1,152 @@
+package bulkerlib
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy computes how long to wait before redelivering a message that has already failed
+// `retries` times. RetryPolicy builds the strategy named by its Strategy field (ConstantBackoff,
+// LinearBackoff or ExponentialBackoff, the ones bulkerapp ships) and uses it to implement
+// NextRetryTime.
+type BackoffStrategy interface {
+	// NextDelay returns the delay before the (retries+1)-th redelivery attempt.
+	NextDelay(retries int) time.Duration
+}
+
+// ConstantBackoff always waits Delay, regardless of how many times the message has already failed.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b ConstantBackoff) NextDelay(retries int) time.Duration {
+	return b.Delay
+}
+
+// LinearBackoff waits Base + Step*retries before each redelivery attempt.
+type LinearBackoff struct {
+	Base time.Duration
+	Step time.Duration
+}
+
+func (b LinearBackoff) NextDelay(retries int) time.Duration {
+	if retries < 0 {
+		retries = 0
+	}
+	return b.Base + b.Step*time.Duration(retries)
+}
+
+// ExponentialBackoff waits min(Base * Factor^retries, Max), then perturbs the result by up to
+// ±Jitter (a 0-1 fraction of the delay) of uniform random jitter, so a burst of failures doesn't
+// all come back at the exact same instant.
+type ExponentialBackoff struct {
+	Base   time.Duration
+	Factor float64
+	Max    time.Duration
+	Jitter float64
+}
+
+func (b ExponentialBackoff) NextDelay(retries int) time.Duration {
+	if retries < 0 {
+		retries = 0
+	}
+	factor := b.Factor
+	if factor <= 0 {
+		factor = 2
+	}
+	delay := float64(b.Base) * math.Pow(factor, float64(retries))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		jitter := delay * b.Jitter
+		delay += (rand.Float64()*2 - 1) * jitter
+		if delay < 0 {
+			delay = 0
+		}
+	}
+	return time.Duration(delay)
+}
+
+// RetryPolicy controls redelivery of failed stream/retry-topic messages: a message that has
+// failed `retries` times so far is rescheduled per Strategy ("exponential" by default: delay =
+// min(BaseDelaySec * Factor^retries, MaxDelaySec), plus up to JitterPct percent of random jitter;
+// "constant" and "linear" are the other built-ins bulkerapp ships). This is the Pulsar-style nack
+// semantics adapted to the Kafka retry-topic model used by bulkerapp: see RetryPolicyOption for how
+// it's configured per destination, and NackRedeliveryDelaySec is the delay applied before a
+// freshly-nacked (zero retries so far) message's first redelivery, independent of Strategy.
+type RetryPolicy struct {
+	// Strategy selects the BackoffStrategy: "exponential" (default), "constant" or "linear".
+	Strategy               string
+	BaseDelaySec           int
+	MaxDelaySec            int
+	Factor                 float64
+	StepSec                int
+	JitterPct              float64
+	NackRedeliveryDelaySec int
+}
+
+// DefaultRetryPolicy is used for destinations that don't set RetryPolicyOption, and to fill in
+// any fields left unset by a partial override.
+var DefaultRetryPolicy = RetryPolicy{
+	Strategy:               "exponential",
+	BaseDelaySec:           60,
+	MaxDelaySec:            3600,
+	Factor:                 2,
+	JitterPct:              10,
+	NackRedeliveryDelaySec: 30,
+}
+
+// BackoffStrategy builds the BackoffStrategy this policy's Strategy field names, filling any
+// unset numeric fields in from DefaultRetryPolicy.
+func (p RetryPolicy) BackoffStrategy() BackoffStrategy {
+	baseDelaySec := p.BaseDelaySec
+	if baseDelaySec <= 0 {
+		baseDelaySec = DefaultRetryPolicy.BaseDelaySec
+	}
+	switch p.Strategy {
+	case "constant":
+		return ConstantBackoff{Delay: time.Duration(baseDelaySec) * time.Second}
+	case "linear":
+		return LinearBackoff{
+			Base: time.Duration(baseDelaySec) * time.Second,
+			Step: time.Duration(p.StepSec) * time.Second,
+		}
+	default:
+		maxDelaySec := p.MaxDelaySec
+		if maxDelaySec <= 0 {
+			maxDelaySec = DefaultRetryPolicy.MaxDelaySec
+		}
+		factor := p.Factor
+		if factor <= 0 {
+			factor = DefaultRetryPolicy.Factor
+		}
+		return ExponentialBackoff{
+			Base:   time.Duration(baseDelaySec) * time.Second,
+			Factor: factor,
+			Max:    time.Duration(maxDelaySec) * time.Second,
+			Jitter: p.JitterPct / 100,
+		}
+	}
+}
+
+// NextRetryTime returns when a message that has failed retries times so far should be
+// redelivered, per this policy.
+func (p RetryPolicy) NextRetryTime(retries int) time.Time {
+	return time.Now().Add(p.NextDelay(retries))
+}
+
+// NextDelay returns the delay before the (retries+1)-th redelivery attempt, per this policy's
+// Strategy - except for a freshly-nacked message (retries <= 0), which always uses
+// NackRedeliveryDelaySec regardless of Strategy.
+func (p RetryPolicy) NextDelay(retries int) time.Duration {
+	if retries <= 0 {
+		delaySec := p.NackRedeliveryDelaySec
+		if delaySec <= 0 {
+			delaySec = DefaultRetryPolicy.NackRedeliveryDelaySec
+		}
+		return time.Duration(delaySec) * time.Second
+	}
+	return p.BackoffStrategy().NextDelay(retries)
+}